@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type AuditAction string
+
+const (
+	AuditSetCourseStatus       AuditAction = "set-course-status"
+	AuditAddCourse             AuditAction = "add-course"
+	AuditSetCourseCapacity     AuditAction = "set-course-capacity"
+	AuditSetRegistrationWindow AuditAction = "set-registration-window"
+	AuditAddTerm               AuditAction = "add-term"
+	AuditUpdateTerm            AuditAction = "update-term"
+	AuditAddClass              AuditAction = "add-class"
+	AuditSetPrerequisite       AuditAction = "set-prerequisite"
+	AuditRemovePrerequisite    AuditAction = "remove-prerequisite"
+	AuditRegisterScores        AuditAction = "register-scores"
+	AuditCloseSubmissions      AuditAction = "close-submissions"
+	AuditAddAnnouncement       AuditAction = "add-announcement"
+
+	AuditCreateUser     AuditAction = "create-user"
+	AuditUpdateUser     AuditAction = "update-user"
+	AuditSetUserStatus  AuditAction = "set-user-status"
+	AuditSetCreditLimit AuditAction = "set-credit-limit"
+	AuditImportUsers    AuditAction = "import-users"
+
+	AuditStartImpersonation  AuditAction = "start-impersonation"
+	AuditEndImpersonation    AuditAction = "end-impersonation"
+	AuditImpersonatedRequest AuditAction = "impersonated-request"
+)
+
+// AuditEntry 監査ログに記録する操作
+// Before/After はJSONとして保存する。ActorIDが空の場合はリクエストのユーザーを記録する
+type AuditEntry struct {
+	ActorID        string
+	Action         AuditAction
+	CourseID       string
+	ClassID        string
+	AnnouncementID string
+	Before         interface{}
+	After          interface{}
+}
+
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullableJSON(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// writeAuditLog 操作したユーザーとリクエストIDを付けて監査ログを追記する
+// 操作と同じトランザクションで書き込めるようにExecerを受け取る
+func writeAuditLog(c echo.Context, db sqlx.Execer, entry AuditEntry) error {
+	actorID := entry.ActorID
+	if actorID == "" {
+		var err error
+		actorID, _, _, _, err = getUserInfo(c)
+		if err != nil {
+			return err
+		}
+	}
+	before, err := nullableJSON(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := nullableJSON(entry.After)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO `audit_logs` (`id`, `actor_id`, `action`, `course_id`, `class_id`, `announcement_id`, `before`, `after`, `request_id`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		newULID(), actorID, entry.Action, nullableString(entry.CourseID), nullableString(entry.ClassID), nullableString(entry.AnnouncementID),
+		before, after, c.Response().Header().Get(echo.HeaderXRequestID))
+	return err
+}
+
+type AuditLog struct {
+	ID             string    `db:"id"`
+	ActorID        string    `db:"actor_id"`
+	ActorCode      string    `db:"actor_code"`
+	ActorName      string    `db:"actor_name"`
+	Action         string    `db:"action"`
+	CourseID       *string   `db:"course_id"`
+	ClassID        *string   `db:"class_id"`
+	AnnouncementID *string   `db:"announcement_id"`
+	Before         []byte    `db:"before"`
+	After          []byte    `db:"after"`
+	RequestID      string    `db:"request_id"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+type AuditLogResponse struct {
+	ID             string          `json:"id"`
+	ActorCode      string          `json:"actor_code"`
+	ActorName      string          `json:"actor_name"`
+	Action         string          `json:"action"`
+	CourseID       *string         `json:"course_id"`
+	ClassID        *string         `json:"class_id"`
+	AnnouncementID *string         `json:"announcement_id"`
+	Before         json.RawMessage `json:"before"`
+	After          json.RawMessage `json:"after"`
+	RequestID      string          `json:"request_id"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// GetAuditLogs GET /api/audit-logs 監査ログの検索
+func (h *handlers) GetAuditLogs(c echo.Context) error {
+	query := "SELECT `audit_logs`.*, `users`.`code` AS `actor_code`, `users`.`name` AS `actor_name`" +
+		" FROM `audit_logs` JOIN `users` ON `audit_logs`.`actor_id` = `users`.`id`" +
+		" WHERE 1=1"
+	var condition string
+	var args []interface{}
+
+	if actor := c.QueryParam("actor"); actor != "" {
+		condition += " AND `users`.`code` = ?"
+		args = append(args, actor)
+	}
+	if action := c.QueryParam("action"); action != "" {
+		condition += " AND `audit_logs`.`action` = ?"
+		args = append(args, action)
+	}
+	for _, column := range []string{"course_id", "class_id", "announcement_id", "request_id"} {
+		if v := c.QueryParam(column); v != "" {
+			condition += fmt.Sprintf(" AND `audit_logs`.`%s` = ?", column)
+			args = append(args, v)
+		}
+	}
+	if since := c.QueryParam("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid since.")
+		}
+		condition += " AND `audit_logs`.`created_at` >= ?"
+		args = append(args, t)
+	}
+	if until := c.QueryParam("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid until.")
+		}
+		condition += " AND `audit_logs`.`created_at` < ?"
+		args = append(args, t)
+	}
+
+	condition += " ORDER BY `audit_logs`.`id` DESC"
+
+	var page int
+	if c.QueryParam("page") == "" {
+		page = 1
+	} else {
+		var err error
+		page, err = strconv.Atoi(c.QueryParam("page"))
+		if err != nil || page <= 0 {
+			return c.String(http.StatusBadRequest, "Invalid page.")
+		}
+	}
+	limit := 20
+	offset := limit * (page - 1)
+
+	// limitより多く上限を設定し、実際にlimitより多くレコードが取得できた場合は次のページが存在する
+	condition += " LIMIT ? OFFSET ?"
+	args = append(args, limit+1, offset)
+
+	var logs []AuditLog
+	if err := h.DB.Select(&logs, query+condition, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var links []string
+	linkURL, err := url.Parse(c.Request().URL.Path + "?" + c.Request().URL.RawQuery)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	q := linkURL.Query()
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page-1))
+		linkURL.RawQuery = q.Encode()
+		links = append(links, fmt.Sprintf("<%v>; rel=\"prev\"", linkURL))
+	}
+	if len(logs) > limit {
+		q.Set("page", strconv.Itoa(page+1))
+		linkURL.RawQuery = q.Encode()
+		links = append(links, fmt.Sprintf("<%v>; rel=\"next\"", linkURL))
+	}
+	if len(links) > 0 {
+		c.Response().Header().Set("Link", strings.Join(links, ","))
+	}
+
+	if len(logs) == limit+1 {
+		logs = logs[:len(logs)-1]
+	}
+
+	// 結果が0件の時は空配列を返却
+	res := make([]AuditLogResponse, 0, len(logs))
+	for _, log := range logs {
+		res = append(res, AuditLogResponse{
+			ID:             log.ID,
+			ActorCode:      log.ActorCode,
+			ActorName:      log.ActorName,
+			Action:         log.Action,
+			CourseID:       log.CourseID,
+			ClassID:        log.ClassID,
+			AnnouncementID: log.AnnouncementID,
+			Before:         log.Before,
+			After:          log.After,
+			RequestID:      log.RequestID,
+			CreatedAt:      log.CreatedAt,
+		})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
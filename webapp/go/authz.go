@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 権限モデル
+//
+// ユーザー種別(users.type)による全体のロールと、科目毎のロール(担当教員・TA)の
+// どちらかで権限を持っていれば操作できる。管理者は全ての科目に対して全ての権限を持つ。
+
+type Permission string
+
+const (
+	PermManageUsers         Permission = "manage-users"
+	PermAddCourse           Permission = "add-course"
+	PermSetCourseStatus     Permission = "set-course-status"
+	PermAddClass            Permission = "add-class"
+	PermGrade               Permission = "grade"
+	PermAnnounce            Permission = "announce"
+	PermManageStaff         Permission = "manage-staff"
+	PermViewAuditLogs       Permission = "view-audit-logs"
+	PermImpersonate         Permission = "impersonate"
+	PermManagePrerequisites Permission = "manage-prerequisites"
+	PermManageTerms         Permission = "manage-terms"
+)
+
+// CourseRole 科目毎のロール
+type CourseRole string
+
+const (
+	CourseTeacher   CourseRole = "teacher"
+	CourseAssistant CourseRole = "assistant"
+)
+
+var userTypePermissions = map[UserType][]Permission{
+	Admin:   {PermManageUsers, PermAddCourse, PermSetCourseStatus, PermAddClass, PermGrade, PermAnnounce, PermManageStaff, PermViewAuditLogs, PermImpersonate, PermManagePrerequisites, PermManageTerms},
+	Teacher: {PermAddCourse},
+	Student: {},
+}
+
+var courseRolePermissions = map[CourseRole][]Permission{
+	CourseTeacher:   {PermSetCourseStatus, PermAddClass, PermGrade, PermAnnounce, PermManageStaff, PermManagePrerequisites},
+	CourseAssistant: {PermGrade, PermAnnounce},
+}
+
+func hasPermission(perms []Permission, perm Permission) bool {
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdminType 教員向けAPIを利用できるユーザー種別か
+func isAdminType(userType UserType) bool {
+	return userType == Teacher || userType == Admin
+}
+
+func getUserType(q sqlx.Queryer, userID string) (UserType, error) {
+	var userType UserType
+	err := sqlx.Get(q, &userType, "SELECT `type` FROM `users` WHERE `id` = ?", userID)
+	return userType, err
+}
+
+// getCourseRole ユーザーの科目でのロール
+// courses.teacher_id の教員は担当教員、担当者でなければ空文字を返す
+func getCourseRole(q sqlx.Queryer, courseID, userID string) (CourseRole, error) {
+	var role CourseRole
+	query := "SELECT 'teacher' FROM `courses` WHERE `id` = ? AND `teacher_id` = ?" +
+		" UNION ALL" +
+		" SELECT `role` FROM `course_staff` WHERE `course_id` = ? AND `user_id` = ?" +
+		" ORDER BY 1 DESC LIMIT 1"
+	if err := sqlx.Get(q, &role, query, courseID, userID, courseID, userID); err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// hasCoursePermission ユーザー種別または科目でのロールにより権限を持っているか
+func (h *handlers) hasCoursePermission(courseID, userID string, perm Permission) (bool, error) {
+	userType, err := getUserType(h.DB, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if hasPermission(userTypePermissions[userType], perm) {
+		return true, nil
+	}
+	if courseID == "" {
+		return false, nil
+	}
+	role, err := getCourseRole(h.DB, courseID, userID)
+	if err != nil {
+		return false, err
+	}
+	return hasPermission(courseRolePermissions[role], perm), nil
+}
+
+// RequirePermission 権限確認用middleware
+// :courseID を含むルートでは科目でのロールも考慮し、
+// :classID を含むルートでは講義がその科目に属していることも確認する
+func (h *handlers) RequirePermission(perm Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userID, _, _, _, err := getUserInfo(c)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+
+			courseID := c.Param("courseID")
+			if courseID != "" {
+				var count int
+				if err := h.DB.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ?", courseID); err != nil {
+					c.Logger().Error(err)
+					return c.NoContent(http.StatusInternalServerError)
+				}
+				if count == 0 {
+					return c.String(http.StatusNotFound, "No such course.")
+				}
+			}
+
+			if ok, err := h.hasCoursePermission(courseID, userID, perm); err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			} else if !ok {
+				return c.String(http.StatusForbidden, "You do not have permission to perform this operation.")
+			}
+
+			if classID := c.Param("classID"); courseID != "" && classID != "" {
+				var count int
+				if err := h.DB.Get(&count, "SELECT COUNT(*) FROM `classes` WHERE `id` = ? AND `course_id` = ?", classID, courseID); err != nil {
+					c.Logger().Error(err)
+					return c.NoContent(http.StatusInternalServerError)
+				}
+				if count == 0 {
+					return c.String(http.StatusNotFound, "No such class.")
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+type CourseStaffMember struct {
+	Code string     `json:"code" db:"code"`
+	Name string     `json:"name" db:"name"`
+	Role CourseRole `json:"role" db:"role"`
+}
+
+// GetCourseStaff GET /api/courses/:courseID/staff 科目の担当者一覧の取得
+func (h *handlers) GetCourseStaff(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	query := "SELECT `users`.`code`, `users`.`name`, 'teacher' AS `role`" +
+		" FROM `courses` JOIN `users` ON `courses`.`teacher_id` = `users`.`id`" +
+		" WHERE `courses`.`id` = ?" +
+		" UNION ALL" +
+		" SELECT `users`.`code`, `users`.`name`, `course_staff`.`role`" +
+		" FROM `course_staff` JOIN `users` ON `course_staff`.`user_id` = `users`.`id`" +
+		" WHERE `course_staff`.`course_id` = ?"
+	res := make([]CourseStaffMember, 0)
+	if err := h.DB.Select(&res, query, courseID, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+type SetCourseStaffRequest struct {
+	Role CourseRole `json:"role"`
+}
+
+// SetCourseStaff PUT /api/courses/:courseID/staff/:userCode 科目の担当者(共同担当教員・TA)の設定
+// 共同担当教員の設定は管理者のみ、TAの設定は担当教員も行える
+func (h *handlers) SetCourseStaff(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	courseID := c.Param("courseID")
+
+	var req SetCourseStaffRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if _, ok := courseRolePermissions[req.Role]; !ok {
+		return c.String(http.StatusBadRequest, "Invalid role.")
+	}
+
+	var staff User
+	if err := h.DB.Get(&staff, "SELECT * FROM `users` WHERE `code` = ?", c.Param("userCode")); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+	if req.Role == CourseTeacher && !isAdminType(staff.Type) {
+		return c.String(http.StatusBadRequest, "Only teachers can be added as a teacher.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var teacherID string
+	if err := tx.Get(&teacherID, "SELECT `teacher_id` FROM `courses` WHERE `id` = ?", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if teacherID == staff.ID {
+		return c.String(http.StatusBadRequest, "This user is the main teacher of this course.")
+	}
+
+	// 共同担当教員の追加に加え、共同担当教員からTAへの変更も管理者のみ行える
+	var currentRole CourseRole
+	if err := tx.Get(&currentRole, "SELECT `role` FROM `course_staff` WHERE `course_id` = ? AND `user_id` = ? FOR UPDATE", courseID, staff.ID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if req.Role == CourseTeacher || currentRole == CourseTeacher {
+		if ok, err := h.hasCoursePermission("", userID, PermManageStaff); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		} else if !ok {
+			return c.String(http.StatusForbidden, "Only administrators can change the teachers of a course.")
+		}
+	}
+
+	if _, err := tx.Exec("INSERT INTO `course_staff` (`course_id`, `user_id`, `role`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `role` = VALUES(`role`)",
+		courseID, staff.ID, req.Role); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RemoveCourseStaff DELETE /api/courses/:courseID/staff/:userCode 科目の担当者の解除
+func (h *handlers) RemoveCourseStaff(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	courseID := c.Param("courseID")
+
+	var staff struct {
+		UserID string     `db:"user_id"`
+		Role   CourseRole `db:"role"`
+	}
+	query := "SELECT `course_staff`.`user_id`, `course_staff`.`role`" +
+		" FROM `course_staff` JOIN `users` ON `course_staff`.`user_id` = `users`.`id`" +
+		" WHERE `course_staff`.`course_id` = ? AND `users`.`code` = ?"
+	if err := h.DB.Get(&staff, query, courseID, c.Param("userCode")); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such staff member.")
+	}
+
+	if staff.Role == CourseTeacher {
+		if ok, err := h.hasCoursePermission("", userID, PermManageStaff); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		} else if !ok {
+			return c.String(http.StatusForbidden, "Only administrators can remove teachers from a course.")
+		}
+	}
+
+	if _, err := h.DB.Exec("DELETE FROM `course_staff` WHERE `course_id` = ? AND `user_id` = ?", courseID, staff.UserID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ---------- Calendar ----------
+
+// 時間割のiCalendar (RFC 5545) エクスポート
+// 履修中の科目の時間割枠毎に、学期の開始日から終了日まで毎週繰り返す予定を出力する。
+// 時限の開始・終了時刻は PERIOD_TIMES (例: "1=08:50-10:30,2=10:40-12:20") で、
+// タイムゾーンは CALENDAR_TIMEZONE で設定する。学期に属さない科目は日付が決まらないので出力しない。
+
+const (
+	periodTimesEnv           = "PERIOD_TIMES"
+	calendarTimezoneEnv      = "CALENDAR_TIMEZONE"
+	defaultPeriodTimes       = "1=08:50-10:30,2=10:40-12:20,3=13:10-14:50,4=15:05-16:45,5=17:00-18:40,6=18:50-20:30"
+	calendarSubscriptionPath = "/api/users/me/calendar-subscription"
+	calendarTokenName        = "calendar subscription"
+	icalDateTimeLayout       = "20060102T150405Z"
+	icalMaxLineOctets        = 75
+)
+
+// 購読用URLの起点 (例: "https://isucholar.example.com")
+// 未設定ならリクエストのホストと、nginxが付ける X-Forwarded-Proto のスキームから組み立てる
+var calendarBaseURL = strings.TrimRight(GetEnv("CALENDAR_BASE_URL", ""), "/")
+
+// PeriodTime 時限の開始・終了時刻 (0時からの経過時間)
+type PeriodTime struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+type CalendarConfig struct {
+	Location *time.Location
+	Periods  map[uint8]PeriodTime
+}
+
+var calendarWeekdays = map[DayOfWeek]time.Weekday{
+	Monday:    time.Monday,
+	Tuesday:   time.Tuesday,
+	Wednesday: time.Wednesday,
+	Thursday:  time.Thursday,
+	Friday:    time.Friday,
+}
+
+// loadCalendarConfig カレンダーの設定を読む
+// タイムゾーンが読めない場合は起動を止めず、日本時間で出力する
+func loadCalendarConfig(logger echo.Logger) (*CalendarConfig, error) {
+	loc, err := time.LoadLocation(GetEnv(calendarTimezoneEnv, "Asia/Tokyo"))
+	if err != nil {
+		logger.Warnf("%s: %v; falling back to JST", calendarTimezoneEnv, err)
+		loc = time.FixedZone("JST", 9*60*60)
+	}
+	periods, err := parsePeriodTimes(GetEnv(periodTimesEnv, defaultPeriodTimes))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", periodTimesEnv, err)
+	}
+	return &CalendarConfig{Location: loc, Periods: periods}, nil
+}
+
+// parsePeriodTimes "<時限>=<HH:MM>-<HH:MM>" のカンマ区切りを読む
+func parsePeriodTimes(s string) (map[uint8]PeriodTime, error) {
+	periods := map[uint8]PeriodTime{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		eq := strings.Index(entry, "=")
+		dash := strings.Index(entry, "-")
+		if eq < 0 || dash < eq {
+			return nil, fmt.Errorf("invalid period time %q", entry)
+		}
+		period, err := strconv.ParseUint(entry[:eq], 10, 8)
+		if err != nil || period == 0 {
+			return nil, fmt.Errorf("invalid period %q", entry[:eq])
+		}
+		start, err := parseClock(entry[eq+1 : dash])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(entry[dash+1:])
+		if err != nil {
+			return nil, err
+		}
+		if end <= start {
+			return nil, fmt.Errorf("period %d ends before it starts", period)
+		}
+		periods[uint8(period)] = PeriodTime{Start: start, End: end}
+	}
+	return periods, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// icalWriter CRLF区切りで、75オクテットを超える行を折り返して書き込む
+type icalWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *icalWriter) line(name, value string) {
+	s := name + ":" + value
+	for len(s) > icalMaxLineOctets {
+		// 折り返した行は先頭の空白を含めて75オクテットに収め、マルチバイト文字の途中では切らない
+		n := icalMaxLineOctets
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		w.buf.WriteString(s[:n])
+		w.buf.WriteString("\r\n")
+		s = " " + s[n:]
+	}
+	w.buf.WriteString(s)
+	w.buf.WriteString("\r\n")
+}
+
+var icalTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func icalText(s string) string {
+	return icalTextEscaper.Replace(s)
+}
+
+type calendarCourse struct {
+	Course
+	TermStartsOn string `db:"term_starts_on"`
+	TermEndsOn   string `db:"term_ends_on"`
+}
+
+// GetCalendarFeed GET /api/users/me/courses.ics 履修中の科目の時間割をiCalendar形式で取得
+func (h *handlers) GetCalendarFeed(c echo.Context) error {
+	userID, userName, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var rows []calendarCourse
+	query := "SELECT `courses`.*," +
+		"   DATE_FORMAT(`terms`.`starts_on`, '%Y-%m-%d') AS `term_starts_on`," +
+		"   DATE_FORMAT(`terms`.`ends_on`, '%Y-%m-%d') AS `term_ends_on`" +
+		" FROM `courses`" +
+		" JOIN `registrations` ON `courses`.`id` = `registrations`.`course_id`" +
+		" JOIN `terms` ON `courses`.`term_id` = `terms`.`id`" +
+		" WHERE `courses`.`status` != ? AND `registrations`.`user_id` = ?" +
+		" ORDER BY `courses`.`code`"
+	if err := h.DB.Select(&rows, query, StatusClosed, userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	courses := make([]Course, 0, len(rows))
+	for _, row := range rows {
+		courses = append(courses, row.Course)
+	}
+	contents, err := h.registeredCourseContents(courses)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	cfg := h.Calendar
+	w := &icalWriter{}
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//ISUCON//ISUCHOLAR//JA")
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	w.line("X-WR-CALNAME", icalText(userName+" の時間割"))
+	w.line("X-WR-TIMEZONE", cfg.Location.String())
+
+	stamp := time.Now().UTC().Format(icalDateTimeLayout)
+	for i, row := range rows {
+		startsOn, err := time.ParseInLocation(termDateLayout, row.TermStartsOn, cfg.Location)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		endsOn, err := time.ParseInLocation(termDateLayout, row.TermEndsOn, cfg.Location)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		until := endsOn.AddDate(0, 0, 1).Add(-time.Second)
+
+		// 時間割枠毎に予定を出力する
+		for _, slot := range contents[i].Slots {
+			period, ok := cfg.Periods[slot.Period]
+			if !ok {
+				continue
+			}
+			weekday, ok := calendarWeekdays[slot.DayOfWeek]
+			if !ok {
+				continue
+			}
+
+			// 学期の開始日以降で最初の授業日
+			first := startsOn.AddDate(0, 0, (int(weekday)-int(startsOn.Weekday())+7)%7)
+			if first.After(endsOn) {
+				continue
+			}
+
+			// 日時はUTCで出力するため、夏時間のあるタイムゾーンでは切り替え後の時刻がずれる
+			w.line("BEGIN", "VEVENT")
+			w.line("UID", fmt.Sprintf("%s-%s-%d@isucholar", row.ID, slot.DayOfWeek, slot.Period))
+			w.line("DTSTAMP", stamp)
+			w.line("DTSTART", first.Add(period.Start).UTC().Format(icalDateTimeLayout))
+			w.line("DTEND", first.Add(period.End).UTC().Format(icalDateTimeLayout))
+			w.line("RRULE", "FREQ=WEEKLY;UNTIL="+until.UTC().Format(icalDateTimeLayout))
+			w.line("SUMMARY", icalText(row.Name))
+			w.line("DESCRIPTION", icalText(fmt.Sprintf("%s %d限 %s", row.Code, slot.Period, contents[i].Teacher)))
+			w.line("END", "VEVENT")
+		}
+	}
+	w.line("END", "VCALENDAR")
+
+	return c.Blob(http.StatusOK, "text/calendar; charset=utf-8", w.buf.Bytes())
+}
+
+type CalendarSubscriptionResponse struct {
+	TokenID string `json:"token_id"`
+	URL     string `json:"url"`
+}
+
+// CreateCalendarSubscription POST /api/users/me/calendar-subscription カレンダーアプリ購読用URLの発行
+// calendar スコープのみのAPIトークンを発行し、URLに含めて返す。購読の停止はトークンの失効で行う
+func (h *handlers) CreateCalendarSubscription(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	t, token, err := h.issueAPIToken(userID, calendarTokenName, []string{string(ScopeCalendar)}, 0)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	baseURL := calendarBaseURL
+	if baseURL == "" {
+		baseURL = c.Scheme() + "://" + c.Request().Host
+	}
+
+	return c.JSON(http.StatusCreated, CalendarSubscriptionResponse{
+		TokenID: t.ID,
+		URL:     baseURL + calendarFeedPath + "?token=" + token,
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ---------- Course Slots ----------
+
+// 科目の時間割枠
+// 週に複数回開講する科目は course_slots に枠を複数持つ。
+// courses.period / day_of_week には互換性のため最初の枠 (曜日・時限順) を保存する。
+
+type CourseSlot struct {
+	DayOfWeek DayOfWeek `json:"day_of_week" db:"day_of_week"`
+	Period    uint8     `json:"period" db:"period"`
+}
+
+func dayOfWeekIndex(day DayOfWeek) int {
+	for i, v := range daysOfWeek {
+		if v == day {
+			return i
+		}
+	}
+	return len(daysOfWeek)
+}
+
+// normalizeCourseSlots 曜日・時限順に並べ、重複を除く
+func normalizeCourseSlots(slots []CourseSlot) []CourseSlot {
+	sorted := append([]CourseSlot(nil), slots...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].DayOfWeek != sorted[j].DayOfWeek {
+			return dayOfWeekIndex(sorted[i].DayOfWeek) < dayOfWeekIndex(sorted[j].DayOfWeek)
+		}
+		return sorted[i].Period < sorted[j].Period
+	})
+	res := make([]CourseSlot, 0, len(sorted))
+	for i, slot := range sorted {
+		if i == 0 || slot != sorted[i-1] {
+			res = append(res, slot)
+		}
+	}
+	return res
+}
+
+func equalCourseSlots(a, b []CourseSlot) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// slotsOverlap 2つの枠の集合に同じ曜日・時限の枠があるか
+func slotsOverlap(a, b []CourseSlot) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getCourseSlots 科目毎の時間割枠 (曜日・時限順)
+func getCourseSlots(q sqlx.Queryer, courseIDs []string) (map[string][]CourseSlot, error) {
+	slots := make(map[string][]CourseSlot, len(courseIDs))
+	if len(courseIDs) == 0 {
+		return slots, nil
+	}
+	var rows []struct {
+		CourseID string `db:"course_id"`
+		CourseSlot
+	}
+	query, args, err := sqlx.In("SELECT `course_id`, `day_of_week`, `period` FROM `course_slots` WHERE `course_id` IN (?) ORDER BY `course_id`, `day_of_week`, `period`", courseIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlx.Select(q, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		slots[row.CourseID] = append(slots[row.CourseID], row.CourseSlot)
+	}
+	return slots, nil
+}
+
+func courseIDsOf(courses []Course) []string {
+	ids := make([]string, 0, len(courses))
+	for _, course := range courses {
+		ids = append(ids, course.ID)
+	}
+	return ids
+}
+
+func insertCourseSlots(tx *sqlx.Tx, courseID string, slots []CourseSlot) error {
+	for _, slot := range slots {
+		if _, err := tx.Exec("INSERT INTO `course_slots` (`course_id`, `day_of_week`, `period`) VALUES (?, ?, ?)", courseID, slot.DayOfWeek, slot.Period); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teacherScheduleConflicts 教員が担当する(共同担当を含む)同じ学期の科目のうち、時間割枠が重なるものの科目コード
+// 終了した学期の科目と closed の科目は対象外。code の科目自身 (同じ科目の再登録) も除く
+func teacherScheduleConflicts(q sqlx.Queryer, teacherID, code string, termID *string, slots []CourseSlot, now time.Time) ([]string, error) {
+	if len(slots) == 0 {
+		return nil, nil
+	}
+	slotConditions := make([]string, 0, len(slots))
+	args := []interface{}{teacherID, teacherID, CourseTeacher, StatusClosed, termID, now.Format(termDateLayout), code}
+	for _, slot := range slots {
+		slotConditions = append(slotConditions, "(`course_slots`.`day_of_week` = ? AND `course_slots`.`period` = ?)")
+		args = append(args, slot.DayOfWeek, slot.Period)
+	}
+
+	var codes []string
+	query := "SELECT DISTINCT `courses`.`code`" +
+		" FROM `courses`" +
+		" JOIN `course_slots` ON `course_slots`.`course_id` = `courses`.`id`" +
+		" LEFT JOIN `terms` ON `courses`.`term_id` = `terms`.`id`" +
+		" WHERE (`courses`.`teacher_id` = ? OR EXISTS (" +
+		"   SELECT 1 FROM `course_staff` WHERE `course_staff`.`course_id` = `courses`.`id` AND `course_staff`.`user_id` = ? AND `course_staff`.`role` = ?))" +
+		" AND `courses`.`status` != ? AND `courses`.`term_id` <=> ?" +
+		" AND (`terms`.`id` IS NULL OR `terms`.`ends_on` >= ?)" +
+		" AND `courses`.`code` != ?" +
+		" AND (" + strings.Join(slotConditions, " OR ") + ")" +
+		" ORDER BY `courses`.`code`"
+	if err := sqlx.Select(q, &codes, query, args...); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ---------- Credit Limit ----------
+
+// 1学期に履修登録できる単位数の上限 (0なら上限なし、学期毎に判定する)
+// 学生毎の上限は管理者が credit_limit_overrides で個別に設定できる (1以上、上限なしには既定値に戻す)
+var defaultCreditLimit = GetEnvInt("CREDIT_LIMIT_PER_TERM", 0)
+
+type CreditLimitExceeded struct {
+	TermID  string `json:"term_id,omitempty"`
+	Credits int    `json:"credits"`
+	Limit   int    `json:"limit"`
+}
+
+// getCreditLimit 学生の単位数の上限 (0なら上限なし)
+func getCreditLimit(q sqlx.Queryer, userID string) (int, error) {
+	var limit int
+	if err := sqlx.Get(q, &limit, "SELECT `credit_limit` FROM `credit_limit_overrides` WHERE `user_id` = ?", userID); err == sql.ErrNoRows {
+		return defaultCreditLimit, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return limit, nil
+}
+
+// creditsByTerm 学期毎の単位数の合計
+func creditsByTerm(courses []Course) map[string]int {
+	credits := map[string]int{}
+	for _, course := range courses {
+		credits[termKey(course.TermID)] += int(course.Credit)
+	}
+	return credits
+}
+
+type CreditLimitResponse struct {
+	Code        string `json:"code"`
+	CreditLimit int    `json:"credit_limit"`
+	Overridden  bool   `json:"overridden"`
+}
+
+// GetUserCreditLimit GET /api/users/:userCode/credit-limit 学生の単位数の上限の取得
+func (h *handlers) GetUserCreditLimit(c echo.Context) error {
+	userCode := c.Param("userCode")
+
+	var userID string
+	if err := h.DB.Get(&userID, "SELECT `id` FROM `users` WHERE `code` = ?", userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+
+	res := CreditLimitResponse{Code: userCode, CreditLimit: defaultCreditLimit}
+	if err := h.DB.Get(&res.CreditLimit, "SELECT `credit_limit` FROM `credit_limit_overrides` WHERE `user_id` = ?", userID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == nil {
+		res.Overridden = true
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+type SetCreditLimitRequest struct {
+	CreditLimit int `json:"credit_limit"`
+}
+
+// SetUserCreditLimit PUT /api/users/:userCode/credit-limit 学生毎の単位数の上限の設定
+func (h *handlers) SetUserCreditLimit(c echo.Context) error {
+	userCode := c.Param("userCode")
+
+	var req SetCreditLimitRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	// 0 は「上限なし」を意味するため、個別の上限としては受け付けない
+	if req.CreditLimit <= 0 {
+		return c.String(http.StatusBadRequest, "Credit limit must be at least 1.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var userID string
+	if err := tx.Get(&userID, "SELECT `id` FROM `users` WHERE `code` = ?", userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+
+	var before interface{}
+	var limit int
+	if err := tx.Get(&limit, "SELECT `credit_limit` FROM `credit_limit_overrides` WHERE `user_id` = ? FOR UPDATE", userID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == nil {
+		before = CreditLimitResponse{Code: userCode, CreditLimit: limit, Overridden: true}
+	}
+
+	if _, err := tx.Exec("INSERT INTO `credit_limit_overrides` (`user_id`, `credit_limit`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `credit_limit` = VALUES(`credit_limit`)",
+		userID, req.CreditLimit); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action: AuditSetCreditLimit,
+		Before: before,
+		After:  CreditLimitResponse{Code: userCode, CreditLimit: req.CreditLimit, Overridden: true},
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ResetUserCreditLimit DELETE /api/users/:userCode/credit-limit 学生毎の単位数の上限を既定値に戻す
+func (h *handlers) ResetUserCreditLimit(c echo.Context) error {
+	userCode := c.Param("userCode")
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var override struct {
+		UserID      string `db:"user_id"`
+		CreditLimit int    `db:"credit_limit"`
+	}
+	query := "SELECT `credit_limit_overrides`.`user_id`, `credit_limit_overrides`.`credit_limit`" +
+		" FROM `credit_limit_overrides` JOIN `users` ON `credit_limit_overrides`.`user_id` = `users`.`id`" +
+		" WHERE `users`.`code` = ? FOR UPDATE"
+	if err := tx.Get(&override, query, userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No credit limit override for this user.")
+	}
+
+	if _, err := tx.Exec("DELETE FROM `credit_limit_overrides` WHERE `user_id` = ?", override.UserID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action: AuditSetCreditLimit,
+		Before: CreditLimitResponse{Code: userCode, CreditLimit: override.CreditLimit, Overridden: true},
+		After:  CreditLimitResponse{Code: userCode, CreditLimit: defaultCreditLimit},
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CSRF対策
+//
+// Cookieで認証する状態変更リクエストは、次のいずれかを満たす場合のみ受け付ける。
+//   - X-CSRF-Token ヘッダがCookieのトークンと一致する (double submit)
+//   - Sec-Fetch-Site が same-origin または none
+//   - Sec-Fetch-Site がなく、Origin が自身または CSRF_TRUSTED_ORIGINS のいずれか
+//   - Sec-Fetch-Site も Origin もない (ブラウザ以外のクライアント)
+//
+// Bearerトークンで認証するリクエストはCookieに依存しないので対象外とする。
+const (
+	csrfCookieName = "isucholar_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+var csrfTrustedOrigins = strings.Split(GetEnv("CSRF_TRUSTED_ORIGINS", ""), ",")
+
+type CSRFTokenResponse struct {
+	Token string `json:"token"`
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func verifyCSRFToken(r *http.Request) bool {
+	token := r.Header.Get(csrfHeaderName)
+	if token == "" {
+		return false
+	}
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) == 1
+}
+
+func isTrustedOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if u.Host == r.Host {
+		return true
+	}
+	for _, trusted := range csrfTrustedOrigins {
+		if trusted != "" && strings.EqualFold(strings.TrimRight(trusted, "/"), u.Scheme+"://"+u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// CSRFProtection CSRF対策用middleware
+func (h *handlers) CSRFProtection(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		if isSafeMethod(r.Method) {
+			return next(c)
+		}
+		if _, ok := bearerToken(c); ok {
+			return next(c)
+		}
+		if verifyCSRFToken(r) {
+			return next(c)
+		}
+
+		if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+			if site == "same-origin" || site == "none" {
+				return next(c)
+			}
+		} else if origin := r.Header.Get(echo.HeaderOrigin); origin != "" {
+			if isTrustedOrigin(r, origin) {
+				return next(c)
+			}
+		} else {
+			return next(c)
+		}
+
+		return c.String(http.StatusForbidden, "CSRF token is missing or invalid.")
+	}
+}
+
+// GetCSRFToken GET /api/csrf-token CSRFトークンの取得
+// 返却したトークンを X-CSRF-Token ヘッダに付けて送る
+func (h *handlers) GetCSRFToken(c echo.Context) error {
+	var token string
+	if cookie, err := c.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		token = cookie.Value
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		token = base64.RawURLEncoding.EncodeToString(b)
+		c.SetCookie(&http.Cookie{
+			Name:     csrfCookieName,
+			Value:    token,
+			Path:     "/",
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, CSRFTokenResponse{Token: token})
+}
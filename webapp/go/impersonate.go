@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 代理閲覧 (ヘルプデスク向け)
+//
+// 管理者のセッションを一定時間だけ指定ユーザーとして振る舞わせる。
+// 代理閲覧中は全てのレスポンスにヘッダを付け、状態を変更するリクエストを拒否し、
+// 全てのリクエストを管理者の操作として監査ログに記録する。
+const (
+	impersonatorIDKey      = "impersonatorID"
+	impersonatorNameKey    = "impersonatorName"
+	impersonatorCodeKey    = "impersonatorCode"
+	impersonatorIsAdminKey = "impersonatorIsAdmin"
+	impersonationExpiryKey = "impersonationExpiresAt"
+
+	impersonatingHeader  = "X-Impersonating"
+	impersonatedByHeader = "X-Impersonated-By"
+	impersonationPath    = "/api/impersonation"
+)
+
+var impersonationMaxDuration = time.Duration(GetEnvInt("IMPERSONATION_MAX_MINUTES", 30)) * time.Minute
+
+// isImpersonating 代理閲覧中のリクエストか
+func isImpersonating(c echo.Context) bool {
+	_, ok := c.Get(impersonatorIDKey).(string)
+	return ok
+}
+
+// sessionOwner セッションの持ち主 (代理閲覧中は管理者本人)
+func sessionOwner(values map[interface{}]interface{}) interface{} {
+	if impersonatorID, ok := values[impersonatorIDKey]; ok {
+		return impersonatorID
+	}
+	return values["userID"]
+}
+
+// endImpersonation セッションを管理者本人に戻す
+func endImpersonation(sess *sessions.Session) {
+	sess.Values["userID"] = sess.Values[impersonatorIDKey]
+	sess.Values["userName"] = sess.Values[impersonatorNameKey]
+	sess.Values["userCode"] = sess.Values[impersonatorCodeKey]
+	sess.Values["isAdmin"] = sess.Values[impersonatorIsAdminKey]
+	delete(sess.Values, impersonatorIDKey)
+	delete(sess.Values, impersonatorNameKey)
+	delete(sess.Values, impersonatorCodeKey)
+	delete(sess.Values, impersonatorIsAdminKey)
+	delete(sess.Values, impersonationExpiryKey)
+}
+
+// serveImpersonated 代理閲覧中のリクエストを処理する (IsLoggedInから呼ぶ)
+func (h *handlers) serveImpersonated(c echo.Context, sess *sessions.Session, impersonatorID string, next echo.HandlerFunc) error {
+	expiresAt, _ := sess.Values[impersonationExpiryKey].(int64)
+	if time.Now().Unix() >= expiresAt {
+		endImpersonation(sess)
+		if err := sess.Save(c.Request(), c.Response()); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.String(http.StatusUnauthorized, "Impersonation has expired.")
+	}
+
+	c.Set(impersonatorIDKey, impersonatorID)
+	impersonatorCode, _ := sess.Values[impersonatorCodeKey].(string)
+	userCode, _ := sess.Values["userCode"].(string)
+	c.Response().Header().Set(impersonatingHeader, userCode)
+	c.Response().Header().Set(impersonatedByHeader, impersonatorCode)
+
+	r := c.Request()
+	var err error
+	// 代理閲覧中に許可する状態変更は代理閲覧の終了のみ
+	endingImpersonation := r.Method == http.MethodDelete && c.Path() == impersonationPath
+	if (!isSafeMethod(r.Method) && !endingImpersonation) || c.Path() == exportAssignmentPath {
+		err = c.String(http.StatusForbidden, "This operation is not allowed while impersonating.")
+	} else {
+		err = next(c)
+	}
+
+	if auditErr := writeAuditLog(c, h.DB, AuditEntry{
+		ActorID: impersonatorID,
+		Action:  AuditImpersonatedRequest,
+		After: map[string]interface{}{
+			"user_code": userCode,
+			"method":    r.Method,
+			"uri":       r.RequestURI,
+			"status":    c.Response().Status,
+		},
+	}); auditErr != nil {
+		c.Logger().Error(auditErr)
+	}
+	return err
+}
+
+type StartImpersonationRequest struct {
+	UserCode string `json:"user_code"`
+	Minutes  int    `json:"minutes"`
+}
+
+type ImpersonationResponse struct {
+	UserCode  string    `json:"user_code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// StartImpersonation POST /api/impersonation 代理閲覧の開始
+func (h *handlers) StartImpersonation(c echo.Context) error {
+	if _, ok := c.Get(tokenUserContextKey).(*tokenUser); ok {
+		return c.String(http.StatusBadRequest, "Impersonation requires a login session.")
+	}
+	// 代理閲覧中に開始すると管理者本人の記録が上書きされてしまう
+	if isImpersonating(c) {
+		return c.String(http.StatusForbidden, "You are already impersonating someone.")
+	}
+
+	var req StartImpersonationRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	duration := impersonationMaxDuration
+	if req.Minutes < 0 {
+		return c.String(http.StatusBadRequest, "Invalid duration.")
+	} else if req.Minutes > 0 && time.Duration(req.Minutes)*time.Minute < duration {
+		duration = time.Duration(req.Minutes) * time.Minute
+	}
+
+	var user User
+	if err := h.DB.Get(&user, "SELECT * FROM `users` WHERE `code` = ?", req.UserCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+	if user.Type == Admin {
+		return c.String(http.StatusForbidden, "Administrators cannot be impersonated.")
+	}
+
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if sess.Values["userID"] == user.ID {
+		return c.String(http.StatusBadRequest, "You cannot impersonate yourself.")
+	}
+
+	expiresAt := time.Now().Add(duration)
+	if err := writeAuditLog(c, h.DB, AuditEntry{
+		Action: AuditStartImpersonation,
+		After:  ImpersonationResponse{UserCode: user.Code, ExpiresAt: expiresAt},
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	sess.Values[impersonatorIDKey] = sess.Values["userID"]
+	sess.Values[impersonatorNameKey] = sess.Values["userName"]
+	sess.Values[impersonatorCodeKey] = sess.Values["userCode"]
+	sess.Values[impersonatorIsAdminKey] = sess.Values["isAdmin"]
+	sess.Values[impersonationExpiryKey] = expiresAt.Unix()
+	sess.Values["userID"] = user.ID
+	sess.Values["userName"] = user.Name
+	sess.Values["userCode"] = user.Code
+	sess.Values["isAdmin"] = isAdminType(user.Type)
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, ImpersonationResponse{UserCode: user.Code, ExpiresAt: expiresAt})
+}
+
+// EndImpersonation DELETE /api/impersonation 代理閲覧の終了
+func (h *handlers) EndImpersonation(c echo.Context) error {
+	if !isImpersonating(c) {
+		return c.String(http.StatusBadRequest, "You are not impersonating anyone.")
+	}
+
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	userCode, _ := sess.Values["userCode"].(string)
+	impersonatorID, _ := sess.Values[impersonatorIDKey].(string)
+	endImpersonation(sess)
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := writeAuditLog(c, h.DB, AuditEntry{
+		ActorID: impersonatorID,
+		Action:  AuditEndImpersonation,
+		Before:  map[string]string{"user_code": userCode},
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
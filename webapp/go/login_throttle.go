@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ログイン試行の制限
+//
+// ユーザーコード毎・クライアントIP毎に失敗回数をRedisで数え、
+// 一定回数を超えると失敗の度に待ち時間を倍々に延ばし、さらに超えると一定時間ロックする。
+var (
+	loginFailureWindow      = time.Duration(GetEnvInt("LOGIN_FAILURE_WINDOW_SEC", 900)) * time.Second
+	loginDelayThreshold     = GetEnvInt("LOGIN_DELAY_THRESHOLD", 3)
+	loginDelayBase          = time.Duration(GetEnvInt("LOGIN_DELAY_BASE_MS", 1000)) * time.Millisecond
+	loginLockoutThreshold   = GetEnvInt("LOGIN_LOCKOUT_THRESHOLD", 10)
+	loginIPLockoutThreshold = GetEnvInt("LOGIN_IP_LOCKOUT_THRESHOLD", 50)
+	loginLockoutDuration    = time.Duration(GetEnvInt("LOGIN_LOCKOUT_SEC", 900)) * time.Second
+)
+
+const (
+	loginFailuresKeyPrefix = "login_failures:"
+	loginLockKeyPrefix     = "login_lock:"
+)
+
+func loginThrottleKeys(code, ip string) []string {
+	return []string{"code:" + code, "ip:" + ip}
+}
+
+// loginRetryAfter ロック中であれば解除までの残り時間を返す
+func (h *handlers) loginRetryAfter(ctx context.Context, code, ip string) (time.Duration, error) {
+	var retryAfter time.Duration
+	for _, key := range loginThrottleKeys(code, ip) {
+		ttl, err := h.Redis.PTTL(ctx, loginLockKeyPrefix+key).Result()
+		if err != nil {
+			return 0, err
+		}
+		if ttl > retryAfter {
+			retryAfter = ttl
+		}
+	}
+	return retryAfter, nil
+}
+
+// recordLoginFailure 失敗回数を加算し、回数に応じて待ち時間またはロックを設定する
+func (h *handlers) recordLoginFailure(ctx context.Context, code, ip string) error {
+	for i, key := range loginThrottleKeys(code, ip) {
+		n, err := h.Redis.Incr(ctx, loginFailuresKeyPrefix+key).Result()
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			if err := h.Redis.Expire(ctx, loginFailuresKeyPrefix+key, loginFailureWindow).Err(); err != nil {
+				return err
+			}
+		}
+		failures := int(n)
+
+		lockoutThreshold := loginLockoutThreshold
+		if i == 1 {
+			lockoutThreshold = loginIPLockoutThreshold
+		}
+		var lock time.Duration
+		if failures >= lockoutThreshold {
+			lock = loginLockoutDuration
+		} else if failures >= loginDelayThreshold {
+			lock = loginDelayBase << uint(failures-loginDelayThreshold)
+			if lock > loginLockoutDuration || lock <= 0 {
+				lock = loginLockoutDuration
+			}
+		}
+		if lock > 0 {
+			if err := h.Redis.Set(ctx, loginLockKeyPrefix+key, failures, lock).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resetLoginFailures ログイン成功時にユーザーコードの失敗回数をリセットする
+// IPの失敗回数は他人のアカウントへの試行を含みうるのでリセットしない
+func (h *handlers) resetLoginFailures(ctx context.Context, code string) error {
+	return h.Redis.Del(ctx, loginFailuresKeyPrefix+"code:"+code, loginLockKeyPrefix+"code:"+code).Err()
+}
+
+func tooManyLoginAttempts(c echo.Context, retryAfter time.Duration) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	return c.String(http.StatusTooManyRequests, "Too many login attempts. Please try again later.")
+}
+
+// ClearLoginLockout DELETE /api/login-lockouts ユーザーコードまたはIPのログインロックを解除
+func (h *handlers) ClearLoginLockout(c echo.Context) error {
+	code := c.QueryParam("code")
+	ip := c.QueryParam("ip")
+	if code == "" && ip == "" {
+		return c.String(http.StatusBadRequest, "Either code or ip is required.")
+	}
+
+	var keys []string
+	if code != "" {
+		keys = append(keys, loginFailuresKeyPrefix+"code:"+code, loginLockKeyPrefix+"code:"+code)
+	}
+	if ip != "" {
+		keys = append(keys, loginFailuresKeyPrefix+"ip:"+ip, loginLockKeyPrefix+"ip:"+ip)
+	}
+	if err := h.Redis.Del(c.Request().Context(), keys...).Err(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail 送信するメール
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer メール送信の抽象
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+var (
+	mailSpoolDirectory = GetEnv("MAIL_SPOOL_DIR", "../mail/")
+	mailFrom           = GetEnv("MAIL_FROM", "noreply@isucholar.example")
+	mailDomain         = GetEnv("MAIL_DOMAIN", "isucholar.example")
+)
+
+// mailAddress ユーザーコードに対応するメールアドレス
+func mailAddress(userCode string) string {
+	return strings.ToLower(userCode) + "@" + mailDomain
+}
+
+// SpoolMailer メールをスプールディレクトリにファイルとして書き出すMailer
+// SMTPサーバがない環境で使う
+type SpoolMailer struct {
+	Dir string
+}
+
+func (m *SpoolMailer) Send(ctx context.Context, mail Mail) error {
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", mailFrom)
+	fmt.Fprintf(&b, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+
+	// 書き込み途中のファイルを読まれないよう一時ファイルからrenameする
+	name := newULID() + ".eml"
+	tmp := filepath.Join(m.Dir, "."+name)
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.Dir, name))
+}
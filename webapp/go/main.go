@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -38,8 +39,11 @@ const (
 )
 
 type handlers struct {
-	DB    *sqlx.DB
-	Redis *redis.Client
+	DB       *sqlx.DB
+	Redis    *redis.Client
+	Sessions *RedisStore
+	Mailer   Mailer
+	Calendar *CalendarConfig
 }
 
 var teacherNameCache = sync.Map{}
@@ -76,10 +80,30 @@ func main() {
 	e.Debug = GetEnv("DEBUG", "") == "true"
 	e.Server.Addr = fmt.Sprintf(":%v", GetEnv("PORT", "7000"))
 	e.HideBanner = true
+	// クライアントIPは同じホストのnginxが付けた X-Forwarded-For からのみ取り出す
+	// (直接アクセスされた場合や信頼しないプロキシを経由した場合は接続元のアドレスを使う)
+	e.IPExtractor = echo.ExtractIPFromXFFHeader(
+		echo.TrustLoopback(true),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	)
 
 	//e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("trapnomura"))))
+	e.Use(middleware.RequestID())
+	keyPairs, err := loadSessionKeyPairs()
+	if err == errNoSessionSecrets && GetEnv(sessionAllowRandomKeysEnv, "") == "true" {
+		e.Logger.Warnf("%s is not set; using a random session key valid only for this process", sessionSecretsEnv)
+		keyPairs, err = randomSessionKeyPairs()
+	}
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	calendarConfig, err := loadCalendarConfig(e.Logger)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
 
 	db, _ := GetDB(false)
 	db.SetMaxOpenConns(40)
@@ -90,44 +114,97 @@ func main() {
 		DB:       0,
 	})
 
+	sessionStore := NewRedisStore(redisClient, keyPairs...)
+	e.Use(session.Middleware(sessionStore))
+
 	h := &handlers{
-		DB:    db,
-		Redis: redisClient,
+		DB:       db,
+		Redis:    redisClient,
+		Sessions: sessionStore,
+		Mailer:   &SpoolMailer{Dir: mailSpoolDirectory},
+		Calendar: calendarConfig,
 	}
+	e.Use(h.CSRFProtection)
 
 	e.POST("/initialize", h.Initialize)
 
 	e.POST("/login", h.Login)
 	e.POST("/logout", h.Logout)
+	e.POST("/password-reset", h.RequestPasswordReset)
+	e.POST("/password-reset/confirm", h.ConfirmPasswordReset)
+	e.GET("/api/csrf-token", h.GetCSRFToken)
 	API := e.Group("/api", h.IsLoggedIn)
 	{
 		usersAPI := API.Group("/users")
 		{
 			usersAPI.GET("/me", h.GetMe)
 			usersAPI.GET("/me/courses", h.GetRegisteredCourses)
+			usersAPI.GET("/me/courses.ics", h.GetCalendarFeed)
+			usersAPI.POST("/me/calendar-subscription", h.CreateCalendarSubscription)
 			usersAPI.PUT("/me/courses", h.RegisterCourses)
+			usersAPI.DELETE("/me/courses/:courseID", h.DropCourse)
 			usersAPI.GET("/me/grades", h.GetGrades)
+			usersAPI.PUT("/me/password", h.ChangePassword)
+			usersAPI.GET("/me/sessions", h.GetMySessions)
+			usersAPI.DELETE("/me/sessions", h.RevokeMyOtherSessions)
+			usersAPI.DELETE("/me/sessions/:sessionID", h.RevokeMySession)
+			usersAPI.GET("/me/waitlist", h.GetMyWaitlist)
+			usersAPI.DELETE("/me/waitlist/:courseID", h.LeaveWaitlist)
+			usersAPI.GET("/me/tokens", h.GetTokens)
+			usersAPI.POST("/me/tokens", h.CreateToken)
+			usersAPI.DELETE("/me/tokens/:tokenID", h.RevokeToken)
+			usersAPI.GET("", h.GetUsers, h.RequirePermission(PermManageUsers))
+			usersAPI.POST("", h.CreateUser, h.RequirePermission(PermManageUsers))
+			usersAPI.POST("/import", h.ImportUsers, h.RequirePermission(PermManageUsers))
+			usersAPI.PUT("/:userCode", h.UpdateUser, h.RequirePermission(PermManageUsers))
+			usersAPI.DELETE("/:userCode", h.SuspendUser, h.RequirePermission(PermManageUsers))
+			usersAPI.PUT("/:userCode/status", h.SetUserStatus, h.RequirePermission(PermManageUsers))
+			usersAPI.DELETE("/:userCode/sessions", h.RevokeUserSessions, h.RequirePermission(PermManageUsers))
+			usersAPI.GET("/:userCode/credit-limit", h.GetUserCreditLimit, h.RequirePermission(PermManageUsers))
+			usersAPI.PUT("/:userCode/credit-limit", h.SetUserCreditLimit, h.RequirePermission(PermManageUsers))
+			usersAPI.DELETE("/:userCode/credit-limit", h.ResetUserCreditLimit, h.RequirePermission(PermManageUsers))
 		}
 		coursesAPI := API.Group("/courses")
 		{
 			coursesAPI.GET("", h.SearchCourses)
-			coursesAPI.POST("", h.AddCourse, h.IsAdmin)
+			coursesAPI.POST("", h.AddCourse, h.RequirePermission(PermAddCourse))
 			coursesAPI.GET("/:courseID", h.GetCourseDetail)
-			coursesAPI.PUT("/:courseID/status", h.SetCourseStatus, h.IsAdmin)
+			coursesAPI.PUT("/:courseID/status", h.SetCourseStatus, h.RequirePermission(PermSetCourseStatus))
+			coursesAPI.PUT("/:courseID/capacity", h.SetCourseCapacity, h.RequirePermission(PermSetCourseStatus))
+			coursesAPI.PUT("/:courseID/registration-window", h.SetCourseRegistrationWindow, h.RequirePermission(PermSetCourseStatus))
+			coursesAPI.GET("/:courseID/prerequisites", h.GetCoursePrerequisites)
+			coursesAPI.PUT("/:courseID/prerequisites/:prerequisiteID", h.SetCoursePrerequisite, h.RequirePermission(PermManagePrerequisites))
+			coursesAPI.DELETE("/:courseID/prerequisites/:prerequisiteID", h.RemoveCoursePrerequisite, h.RequirePermission(PermManagePrerequisites))
+			coursesAPI.GET("/:courseID/staff", h.GetCourseStaff, h.RequirePermission(PermManageStaff))
+			coursesAPI.PUT("/:courseID/staff/:userCode", h.SetCourseStaff, h.RequirePermission(PermManageStaff))
+			coursesAPI.DELETE("/:courseID/staff/:userCode", h.RemoveCourseStaff, h.RequirePermission(PermManageStaff))
 			coursesAPI.GET("/:courseID/classes", h.GetClasses)
-			coursesAPI.POST("/:courseID/classes", h.AddClass, h.IsAdmin)
+			coursesAPI.POST("/:courseID/classes", h.AddClass, h.RequirePermission(PermAddClass))
 			coursesAPI.POST("/:courseID/classes/:classID/assignments", h.SubmitAssignment)
-			coursesAPI.PUT("/:courseID/classes/:classID/assignments/scores", h.RegisterScores, h.IsAdmin)
-			coursesAPI.GET("/:courseID/classes/:classID/assignments/export", h.DownloadSubmittedAssignments, h.IsAdmin)
+			coursesAPI.PUT("/:courseID/classes/:classID/assignments/scores", h.RegisterScores, h.RequirePermission(PermGrade))
+			coursesAPI.GET("/:courseID/classes/:classID/assignments/export", h.DownloadSubmittedAssignments, h.RequirePermission(PermGrade))
+		}
+		API.DELETE("/login-lockouts", h.ClearLoginLockout, h.RequirePermission(PermManageUsers))
+		API.GET("/audit-logs", h.GetAuditLogs, h.RequirePermission(PermViewAuditLogs))
+		termsAPI := API.Group("/terms")
+		{
+			termsAPI.GET("", h.GetTerms)
+			termsAPI.POST("", h.AddTerm, h.RequirePermission(PermManageTerms))
+			termsAPI.GET("/:termID", h.GetTerm)
+			termsAPI.PUT("/:termID", h.UpdateTerm, h.RequirePermission(PermManageTerms))
 		}
+		API.POST("/impersonation", h.StartImpersonation, h.RequirePermission(PermImpersonate))
+		API.DELETE("/impersonation", h.EndImpersonation)
 		announcementsAPI := API.Group("/announcements")
 		{
 			announcementsAPI.GET("", h.GetAnnouncementList)
-			announcementsAPI.POST("", h.AddAnnouncement, h.IsAdmin)
+			announcementsAPI.POST("", h.AddAnnouncement)
 			announcementsAPI.GET("/:announcementID", h.GetAnnouncementDetail)
 		}
 	}
 
+	go h.runRegistrationScheduler(context.Background(), e.Logger)
+
 	e.Logger.Error(e.StartServer(e.Server))
 }
 
@@ -180,6 +257,19 @@ func (h *handlers) Initialize(c echo.Context) error {
 // IsLoggedIn ログイン確認用middleware
 func (h *handlers) IsLoggedIn(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		if token, ok := bearerToken(c); ok {
+			if ok, err := h.authenticateToken(c, token, false); !ok {
+				return err
+			}
+			return next(c)
+		}
+		if token, ok := calendarFeedToken(c); ok {
+			if ok, err := h.authenticateToken(c, token, true); !ok {
+				return err
+			}
+			return next(c)
+		}
+
 		sess, err := session.Get(SessionName, c)
 		if err != nil {
 			c.Logger().Error(err)
@@ -192,26 +282,12 @@ func (h *handlers) IsLoggedIn(next echo.HandlerFunc) echo.HandlerFunc {
 		if !ok {
 			return c.String(http.StatusUnauthorized, "You are not logged in.")
 		}
-
-		return next(c)
-	}
-}
-
-// IsAdmin admin確認用middleware
-func (h *handlers) IsAdmin(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		sess, err := session.Get(SessionName, c)
-		if err != nil {
+		if err := h.Sessions.Touch(c.Request().Context(), sess.ID); err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
-		isAdmin, ok := sess.Values["isAdmin"]
-		if !ok {
-			c.Logger().Error("failed to get isAdmin from session")
-			return c.NoContent(http.StatusInternalServerError)
-		}
-		if !isAdmin.(bool) {
-			return c.String(http.StatusForbidden, "You are not admin user.")
+		if impersonatorID, ok := sess.Values[impersonatorIDKey].(string); ok {
+			return h.serveImpersonated(c, sess, impersonatorID, next)
 		}
 
 		return next(c)
@@ -219,6 +295,9 @@ func (h *handlers) IsAdmin(next echo.HandlerFunc) echo.HandlerFunc {
 }
 
 func getUserInfo(c echo.Context) (userID string, userName string, isAdmin bool, userCode string, err error) {
+	if u, ok := c.Get(tokenUserContextKey).(*tokenUser); ok {
+		return u.ID, u.Name, u.IsAdmin, u.Code, nil
+	}
 	sess, err := session.Get(SessionName, c)
 	if err != nil {
 		return "", "", false, "", err
@@ -247,14 +326,17 @@ type UserType string
 const (
 	Student UserType = "student"
 	Teacher UserType = "teacher"
+	// Admin 全ての科目を管理できる管理者
+	Admin UserType = "admin"
 )
 
 type User struct {
-	ID             string   `db:"id"`
-	Code           string   `db:"code"`
-	Name           string   `db:"name"`
-	HashedPassword []byte   `db:"hashed_password"`
-	Type           UserType `db:"type"`
+	ID             string     `db:"id"`
+	Code           string     `db:"code"`
+	Name           string     `db:"name"`
+	HashedPassword []byte     `db:"hashed_password"`
+	Type           UserType   `db:"type"`
+	Status         UserStatus `db:"status"`
 }
 
 type UserIDAndCode struct {
@@ -301,6 +383,12 @@ type Course struct {
 	TeacherID   string       `db:"teacher_id"`
 	Keywords    string       `db:"keywords"`
 	Status      CourseStatus `db:"status"`
+	TermID      *string      `db:"term_id"`
+	Capacity    *int         `db:"capacity"`
+	StartedAt   sql.NullTime `db:"started_at"`
+
+	RegistrationOpensAt  *time.Time `db:"registration_opens_at"`
+	RegistrationClosesAt *time.Time `db:"registration_closes_at"`
 }
 
 // ---------- Public API ----------
@@ -317,17 +405,50 @@ func (h *handlers) Login(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid format.")
 	}
 
+	ctx := c.Request().Context()
+	ip := c.RealIP()
+	if retryAfter, err := h.loginRetryAfter(ctx, req.Code, ip); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if retryAfter > 0 {
+		return tooManyLoginAttempts(c, retryAfter)
+	}
+
 	var user User
 	if err := h.DB.Get(&user, "SELECT * FROM `users` WHERE `code` = ?", req.Code); err != nil && err != sql.ErrNoRows {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	} else if err == sql.ErrNoRows {
+		if err := h.recordLoginFailure(ctx, req.Code, ip); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 		return c.String(http.StatusUnauthorized, "Code or Password is wrong.")
 	}
 
 	if bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(req.Password)) != nil {
+		if err := h.recordLoginFailure(ctx, req.Code, ip); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 		return c.String(http.StatusUnauthorized, "Code or Password is wrong.")
 	}
+	if user.Status != UserActive {
+		return c.String(http.StatusForbidden, inactiveUserMessage(user.Status))
+	}
+	if err := h.resetLoginFailures(ctx, req.Code); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 初期データなど低コストでハッシュ化されたパスワードは現在のコストでハッシュ化し直す
+	if needsRehash(user.HashedPassword) {
+		if newHash, err := hashPassword(req.Password); err != nil {
+			c.Logger().Error(err)
+		} else if _, err := h.DB.Exec("UPDATE `users` SET `hashed_password` = ? WHERE `id` = ? AND `hashed_password` = ?", newHash, user.ID, user.HashedPassword); err != nil {
+			c.Logger().Error(err)
+		}
+	}
 
 	sess, err := session.Get(SessionName, c)
 	if err != nil {
@@ -339,9 +460,19 @@ func (h *handlers) Login(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "You are already logged in.")
 	}
 
+	// セッション固定攻撃対策としてログインの度にセッションIDを発行し直す
+	if !sess.IsNew {
+		if err := h.Sessions.delete(ctx, sess.ID, sessionOwner(sess.Values)); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	// 代理閲覧の状態などを新しいセッションに引き継がない
+	sess.ID = ""
+	sess.Values = map[interface{}]interface{}{}
 	sess.Values["userID"] = user.ID
 	sess.Values["userName"] = user.Name
-	sess.Values["isAdmin"] = user.Type == Teacher
+	sess.Values["isAdmin"] = isAdminType(user.Type)
 	sess.Values["userCode"] = user.Code
 	sess.Options = &sessions.Options{
 		Path:   "/",
@@ -380,9 +511,10 @@ func (h *handlers) Logout(c echo.Context) error {
 // ---------- Users API ----------
 
 type GetMeResponse struct {
-	Code    string `json:"code"`
-	Name    string `json:"name"`
-	IsAdmin bool   `json:"is_admin"`
+	Code           string `json:"code"`
+	Name           string `json:"name"`
+	IsAdmin        bool   `json:"is_admin"`
+	ImpersonatedBy string `json:"impersonated_by,omitempty"`
 }
 
 // GetMe GET /api/users/me 自身の情報を取得
@@ -394,18 +526,20 @@ func (h *handlers) GetMe(c echo.Context) error {
 	}
 
 	return c.JSON(http.StatusOK, GetMeResponse{
-		Code:    userCode,
-		Name:    userName,
-		IsAdmin: isAdmin,
+		Code:           userCode,
+		Name:           userName,
+		IsAdmin:        isAdmin,
+		ImpersonatedBy: c.Response().Header().Get(impersonatedByHeader),
 	})
 }
 
 type GetRegisteredCourseResponseContent struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	Teacher   string    `json:"teacher"`
-	Period    uint8     `json:"period"`
-	DayOfWeek DayOfWeek `json:"day_of_week"`
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Teacher   string       `json:"teacher"`
+	Period    uint8        `json:"period"`
+	DayOfWeek DayOfWeek    `json:"day_of_week"`
+	Slots     []CourseSlot `json:"slots"`
 }
 
 // GetRegisteredCourses GET /api/users/me/courses 履修中の科目一覧取得
@@ -421,10 +555,31 @@ func (h *handlers) GetRegisteredCourses(c echo.Context) error {
 		" FROM `courses`" +
 		" JOIN `registrations` ON `courses`.`id` = `registrations`.`course_id`" +
 		" WHERE `courses`.`status` != ? AND `registrations`.`user_id` = ?"
-	if err := h.DB.Select(&courses, query, StatusClosed, userID); err != nil {
+	args := []interface{}{StatusClosed, userID}
+	if termID := c.QueryParam("term_id"); termID != "" {
+		query += " AND `courses`.`term_id` = ?"
+		args = append(args, termID)
+	}
+	if err := h.DB.Select(&courses, query, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res, err := h.registeredCourseContents(courses)
+	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// registeredCourseContents 時間割の表示用に担当教員名と時間割枠を付与する
+func (h *handlers) registeredCourseContents(courses []Course) ([]GetRegisteredCourseResponseContent, error) {
+	slots, err := getCourseSlots(h.DB, courseIDsOf(courses))
+	if err != nil {
+		return nil, err
+	}
+
 	// 履修科目が0件の時は空配列を返却
 	res := make([]GetRegisteredCourseResponseContent, 0, len(courses))
 	for _, course := range courses {
@@ -434,8 +589,7 @@ func (h *handlers) GetRegisteredCourses(c echo.Context) error {
 			teacherName = name.(string)
 		} else {
 			if err := h.DB.Get(&teacher, "SELECT name FROM `users` WHERE `id` = ?", course.TeacherID); err != nil {
-				c.Logger().Error(err)
-				return c.NoContent(http.StatusInternalServerError)
+				return nil, err
 			}
 			teacherName = teacher.Name
 			teacherNameCache.Store(course.TeacherID, teacherName)
@@ -447,29 +601,77 @@ func (h *handlers) GetRegisteredCourses(c echo.Context) error {
 			Teacher:   teacherName,
 			Period:    course.Period,
 			DayOfWeek: course.DayOfWeek,
+			Slots:     slots[course.ID],
 		})
 	}
-
-	return c.JSON(http.StatusOK, res)
+	return res, nil
 }
 
 type RegisterCourseRequestContent struct {
 	ID string `json:"id"`
+	// 定員に達している場合にキャンセル待ちに登録する
+	Waitlist bool `json:"waitlist,omitempty"`
 }
 
 type RegisterCoursesErrorResponse struct {
-	CourseNotFound       []string `json:"course_not_found,omitempty"`
-	NotRegistrableStatus []string `json:"not_registrable_status,omitempty"`
-	ScheduleConflict     []string `json:"schedule_conflict,omitempty"`
+	CourseNotFound       []string             `json:"course_not_found,omitempty"`
+	NotRegistrableStatus []string             `json:"not_registrable_status,omitempty"`
+	ScheduleConflict     []string             `json:"schedule_conflict,omitempty"`
+	CapacityFull         []string             `json:"capacity_full,omitempty"`
+	PrerequisiteNotMet   []string             `json:"prerequisite_not_met,omitempty"`
+	CreditLimitExceeded  *CreditLimitExceeded `json:"credit_limit_exceeded,omitempty"`
+}
+
+func (e RegisterCoursesErrorResponse) hasErrors() bool {
+	return len(e.CourseNotFound) > 0 || len(e.NotRegistrableStatus) > 0 || len(e.ScheduleConflict) > 0 ||
+		len(e.CapacityFull) > 0 || len(e.PrerequisiteNotMet) > 0 || e.CreditLimitExceeded != nil
+}
+
+// RegistrationOutcome 部分登録モードでの科目毎の結果
+type RegistrationOutcome string
+
+const (
+	OutcomeRegistered          RegistrationOutcome = "registered"
+	OutcomeAlreadyRegistered   RegistrationOutcome = "already_registered"
+	OutcomeNotFound            RegistrationOutcome = "not_found"
+	OutcomeNotRegistrable      RegistrationOutcome = "not_registrable"
+	OutcomeConflict            RegistrationOutcome = "conflict"
+	OutcomeCapacityFull        RegistrationOutcome = "capacity_full"
+	OutcomeWaitlisted          RegistrationOutcome = "waitlisted"
+	OutcomePrerequisiteNotMet  RegistrationOutcome = "prerequisite_not_met"
+	OutcomeCreditLimitExceeded RegistrationOutcome = "credit_limit_exceeded"
+)
+
+type RegisterCourseResult struct {
+	ID      string              `json:"id"`
+	Outcome RegistrationOutcome `json:"outcome"`
+}
+
+type RegisterCoursesPartialResponse struct {
+	Results []RegisterCourseResult `json:"results"`
+}
+
+type RegisterCoursesDryRunResponse struct {
+	Valid  bool                         `json:"valid"`
+	Errors RegisterCoursesErrorResponse `json:"errors"`
+	// 部分登録モードでの科目毎の結果
+	Results []RegisterCourseResult `json:"results,omitempty"`
+	// 登録後の時間割 (エラーになった科目は含まない)
+	Timetable  []GetRegisteredCourseResponseContent `json:"timetable"`
+	Waitlisted []string                             `json:"waitlisted"`
 }
 
 // RegisterCourses PUT /api/users/me/courses 履修登録
+// ?dry_run=true の場合は検証のみ行い、エラーと登録後の時間割を返す (MySQL・Redisへの書き込みはしない)
+// ?partial=true の場合は登録できる科目だけを登録し、科目毎の結果を返す
 func (h *handlers) RegisterCourses(c echo.Context) error {
 	userID, _, _, _, err := getUserInfo(c)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	dryRun := c.QueryParam("dry_run") == "true"
+	partial := c.QueryParam("partial") == "true"
 
 	var req []RegisterCourseRequestContent
 	if err := c.Bind(&req); err != nil {
@@ -478,33 +680,63 @@ func (h *handlers) RegisterCourses(c echo.Context) error {
 	sort.Slice(req, func(i, j int) bool {
 		return req[i].ID < req[j].ID
 	})
+	// 同じ科目が重複して指定された場合は1件にまとめる (単位数を二重に数えないため)
+	deduped := req[:0]
+	for _, courseReq := range req {
+		if n := len(deduped); n > 0 && deduped[n-1].ID == courseReq.ID {
+			deduped[n-1].Waitlist = deduped[n-1].Waitlist || courseReq.Waitlist
+			continue
+		}
+		deduped = append(deduped, courseReq)
+	}
+	req = deduped
 
-	tx, err := h.DB.Beginx()
+	tx, err := h.DB.BeginTxx(c.Request().Context(), &sql.TxOptions{ReadOnly: dryRun})
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer tx.Rollback()
 
+	termWindows := newTermRegistrationWindows(tx)
+	now := time.Now()
+
+	// dry-run は読み取り専用のトランザクションで実行し、実際の登録を妨げないよう行ロックを取らない
+	courseLock := " FOR SHARE"
+	readCapacity := lockCourseCapacity
+	if dryRun {
+		courseLock = ""
+		readCapacity = peekCourseCapacity
+	}
+
 	var errors RegisterCoursesErrorResponse
 	var newlyAdded []Course
+	var waitlisted []string
+	outcomes := make(map[string]RegistrationOutcome, len(req))
 	for _, courseReq := range req {
 		courseID := courseReq.ID
 		var course Course
 		if cs, found := courseCache.Load(courseID); found {
 			course = cs.(Course)
 		} else {
-			if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR SHARE", courseID); err != nil && err != sql.ErrNoRows {
+			if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ?"+courseLock, courseID); err != nil && err != sql.ErrNoRows {
 				c.Logger().Error(err)
 				return c.NoContent(http.StatusInternalServerError)
 			} else if err == sql.ErrNoRows {
 				errors.CourseNotFound = append(errors.CourseNotFound, courseReq.ID)
+				outcomes[courseID] = OutcomeNotFound
 				continue
 			}
 			courseCache.Store(courseID, course)
 		}
-		if course.Status != StatusRegistration {
+		termWindow, err := termWindows.forCourse(course)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if course.Status != StatusRegistration || !courseRegistrationWindow(course, termWindow).contains(now) {
 			errors.NotRegistrableStatus = append(errors.NotRegistrableStatus, course.ID)
+			outcomes[courseID] = OutcomeNotRegistrable
 			continue
 		}
 
@@ -515,6 +747,33 @@ func (h *handlers) RegisterCourses(c echo.Context) error {
 			return c.NoContent(http.StatusInternalServerError)
 		}
 		if count > 0 {
+			outcomes[courseID] = OutcomeAlreadyRegistered
+			continue
+		}
+
+		if ok, err := meetsPrerequisites(tx, course.ID, userID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		} else if !ok {
+			errors.PrerequisiteNotMet = append(errors.PrerequisiteNotMet, course.ID)
+			outcomes[courseID] = OutcomePrerequisiteNotMet
+			continue
+		}
+
+		// キャッシュの科目は定員の変更を反映していないことがあるので、定員は常にDBから読む
+		capacity, registered, err := readCapacity(tx, course.ID)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if capacity != nil && registered >= *capacity {
+			if courseReq.Waitlist {
+				waitlisted = append(waitlisted, course.ID)
+				outcomes[courseID] = OutcomeWaitlisted
+			} else {
+				errors.CapacityFull = append(errors.CapacityFull, course.ID)
+				outcomes[courseID] = OutcomeCapacityFull
+			}
 			continue
 		}
 
@@ -530,45 +789,256 @@ func (h *handlers) RegisterCourses(c echo.Context) error {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	slots, err := getCourseSlots(tx, append(courseIDsOf(alreadyRegistered), courseIDsOf(newlyAdded)...))
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if partial {
+		// 登録済みの科目と先に受け付けた科目に対して、時間割の重複と単位数の上限を順に確認する
+		limit, err := getCreditLimit(tx, userID)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		credits := creditsByTerm(alreadyRegistered)
+		accepted := make([]Course, 0, len(newlyAdded))
+		for _, course := range newlyAdded {
+			if hasScheduleConflict(course, alreadyRegistered, slots) {
+				outcomes[course.ID] = OutcomeConflict
+				continue
+			}
+			term := termKey(course.TermID)
+			if limit > 0 && credits[term]+int(course.Credit) > limit {
+				outcomes[course.ID] = OutcomeCreditLimitExceeded
+				continue
+			}
+			credits[term] += int(course.Credit)
+			alreadyRegistered = append(alreadyRegistered, course)
+			accepted = append(accepted, course)
+			outcomes[course.ID] = OutcomeRegistered
+		}
+		newlyAdded = accepted
+		errors = RegisterCoursesErrorResponse{}
+	} else {
+		alreadyRegistered = append(alreadyRegistered, newlyAdded...)
+		for _, course := range newlyAdded {
+			if hasScheduleConflict(course, alreadyRegistered, slots) {
+				errors.ScheduleConflict = append(errors.ScheduleConflict, course.ID)
+			}
+		}
+
+		if len(newlyAdded) > 0 {
+			limit, err := getCreditLimit(tx, userID)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			credits := creditsByTerm(alreadyRegistered)
+			for _, course := range newlyAdded {
+				term := termKey(course.TermID)
+				if limit > 0 && credits[term] > limit {
+					errors.CreditLimitExceeded = &CreditLimitExceeded{TermID: term, Credits: credits[term], Limit: limit}
+					break
+				}
+			}
+		}
+	}
+
+	var results []RegisterCourseResult
+	if partial {
+		results = make([]RegisterCourseResult, 0, len(req))
+		for _, courseReq := range req {
+			results = append(results, RegisterCourseResult{ID: courseReq.ID, Outcome: outcomes[courseReq.ID]})
+		}
+	}
 
-	alreadyRegistered = append(alreadyRegistered, newlyAdded...)
-	for _, course1 := range newlyAdded {
-		for _, course2 := range alreadyRegistered {
-			if course1.ID != course2.ID && course1.Period == course2.Period && course1.DayOfWeek == course2.DayOfWeek {
-				errors.ScheduleConflict = append(errors.ScheduleConflict, course1.ID)
-				break
+	if dryRun {
+		timetable := make([]Course, 0, len(alreadyRegistered))
+		for _, course := range alreadyRegistered {
+			if !containsString(errors.ScheduleConflict, course.ID) {
+				timetable = append(timetable, course)
 			}
 		}
+		res := RegisterCoursesDryRunResponse{
+			Valid:      !errors.hasErrors(),
+			Errors:     errors,
+			Results:    results,
+			Waitlisted: waitlisted,
+		}
+		if res.Waitlisted == nil {
+			res.Waitlisted = []string{}
+		}
+		if res.Timetable, err = h.registeredCourseContents(timetable); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		return c.JSON(http.StatusOK, res)
 	}
 
-	if len(errors.CourseNotFound) > 0 || len(errors.NotRegistrableStatus) > 0 || len(errors.ScheduleConflict) > 0 {
+	if errors.hasErrors() {
 		return c.JSON(http.StatusBadRequest, errors)
 	}
-	regArgs := make([]interface{}, 0, len(newlyAdded)*2)
-	for _, course := range newlyAdded {
-		regArgs = append(regArgs, course.ID)
-		regArgs = append(regArgs, userID)
-		if err := h.Redis.SAdd(context.TODO(), "registrations:"+course.ID, userID).Err(); err != nil {
+	if len(newlyAdded) > 0 {
+		regArgs := make([]interface{}, 0, len(newlyAdded)*2)
+		courseIDs := make([]string, 0, len(newlyAdded))
+		for _, course := range newlyAdded {
+			regArgs = append(regArgs, course.ID)
+			regArgs = append(regArgs, userID)
+			courseIDs = append(courseIDs, course.ID)
+			if err := h.Redis.SAdd(context.TODO(), "registrations:"+course.ID, userID).Err(); err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+		}
+
+		_, err = tx.Exec(
+			"INSERT IGNORE INTO `registrations` (`course_id`, `user_id`) "+
+				"VALUES (?, ?)"+strings.Repeat(",(?,?)", len(newlyAdded)-1), regArgs...,
+		)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		// キャンセル待ちしていた科目に直接登録できた場合はキャンセル待ちから外す
+		q, args, err := sqlx.In("DELETE FROM `waitlists` WHERE `user_id` = ? AND `course_id` IN (?)", userID, courseIDs)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if _, err := tx.Exec(q, args...); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	for _, courseID := range waitlisted {
+		if _, err := tx.Exec("INSERT IGNORE INTO `waitlists` (`course_id`, `user_id`) VALUES (?, ?)", courseID, userID); err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
 
-	_, err = tx.Exec(
-		"INSERT IGNORE INTO `registrations` (`course_id`, `user_id`) "+
-			"VALUES (?, ?)"+strings.Repeat(",(?,?)", len(newlyAdded)-1), regArgs...,
-	)
+	if err = tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if partial {
+		return c.JSON(http.StatusOK, RegisterCoursesPartialResponse{Results: results})
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// hasScheduleConflict 科目がいずれかの時間割枠で同じ学期の他の科目と重複しているか
+func hasScheduleConflict(course Course, others []Course, slots map[string][]CourseSlot) bool {
+	for _, other := range others {
+		if course.ID != other.ID && sameTerm(course, other) && slotsOverlap(slots[course.ID], slots[other.ID]) {
+			return true
+		}
+	}
+	return false
+}
+
+// 開講後も履修を取り消せる期間
+var courseDropGracePeriod = time.Duration(GetEnvInt("COURSE_DROP_GRACE_MIN", 0)) * time.Minute
+
+// isDroppable 履修を取り消せるか
+// 履修登録期間中、または開講後の猶予期間内であれば取り消せる
+func isDroppable(course Course, now time.Time) bool {
+	switch course.Status {
+	case StatusRegistration:
+		return true
+	case StatusInProgress:
+		return course.StartedAt.Valid && now.Before(course.StartedAt.Time.Add(courseDropGracePeriod))
+	default:
+		return false
+	}
+}
+
+// DropCourse DELETE /api/users/me/courses/:courseID 履修の取り消し
+func (h *handlers) DropCourse(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	courseID := c.Param("courseID")
 
-	if err = tx.Commit(); err != nil {
+	tx, err := h.DB.Beginx()
+	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	defer tx.Rollback()
 
-	return c.NoContent(http.StatusOK)
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM `registrations` WHERE `course_id` = ? AND `user_id` = ?", courseID, userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "You are not registered in this course.")
+	}
+	if !isDroppable(course, time.Now()) {
+		return c.String(http.StatusBadRequest, "This course can no longer be dropped.")
+	}
+
+	if _, err := tx.Exec("DELETE FROM `registrations` WHERE `course_id` = ? AND `user_id` = ?", courseID, userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var announcementIDs []string
+	if err := tx.Select(&announcementIDs, "SELECT `id` FROM `announcements` WHERE `course_id` = ?", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 空いた枠にキャンセル待ちの学生を繰り上げる
+	promoted, err := h.promoteWaitlist(tx, courseID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// Redisへの反映はコミットできた場合のみ行う
+	ctx := c.Request().Context()
+	if err := h.Redis.SRem(ctx, "registrations:"+courseID, userID).Err(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 取り消した科目のお知らせを未読から外す
+	if len(announcementIDs) > 0 {
+		members := make([]interface{}, 0, len(announcementIDs))
+		for _, id := range announcementIDs {
+			members = append(members, id)
+		}
+		if err := h.Redis.SRem(ctx, "unread_announcements:"+userID, members...).Err(); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	if err := h.publishPromotions(ctx, courseID, promoted); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
 }
 
 type Class struct {
@@ -669,12 +1139,19 @@ func (h *handlers) GetGrades(c echo.Context) error {
 	}
 
 	// 履修している科目一覧取得
+	// ?term_id= を指定した場合はその学期の科目だけを対象にする (GPAの統計値は全体のまま)
 	var registeredCourses []Course
 	query := "SELECT `courses`.*" +
 		" FROM `registrations`" +
 		" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id`" +
-		" WHERE `user_id` = ? ORDER BY `course_id`"
-	if err := h.DB.Select(&registeredCourses, query, userID); err != nil {
+		" WHERE `user_id` = ?"
+	args := []interface{}{userID}
+	if termID := c.QueryParam("term_id"); termID != "" {
+		query += " AND `courses`.`term_id` = ?"
+		args = append(args, termID)
+	}
+	query += " ORDER BY `course_id`"
+	if err := h.DB.Select(&registeredCourses, query, args...); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
@@ -880,16 +1357,22 @@ func (h *handlers) SearchCourses(c echo.Context) error {
 		args = append(args, teacher)
 	}
 
+	// 時限と曜日はいずれかの時間割枠が一致する科目を返す (両方指定した場合は同じ枠で一致すること)
+	var slotCondition string
 	if period, err := strconv.Atoi(c.QueryParam("period")); err == nil && period > 0 {
-		condition += " AND `courses`.`period` = ?"
+		slotCondition += " AND `course_slots`.`period` = ?"
 		args = append(args, period)
 	}
 
 	if dayOfWeek := c.QueryParam("day_of_week"); dayOfWeek != "" {
-		condition += " AND `courses`.`day_of_week` = ?"
+		slotCondition += " AND `course_slots`.`day_of_week` = ?"
 		args = append(args, dayOfWeek)
 	}
 
+	if slotCondition != "" {
+		condition += " AND EXISTS (SELECT 1 FROM `course_slots` WHERE `course_slots`.`course_id` = `courses`.`id`" + slotCondition + ")"
+	}
+
 	if keywords := c.QueryParam("keywords"); keywords != "" {
 		arr := strings.Split(keywords, " ")
 		var nameCondition string
@@ -910,6 +1393,11 @@ func (h *handlers) SearchCourses(c echo.Context) error {
 		args = append(args, status)
 	}
 
+	if termID := c.QueryParam("term_id"); termID != "" {
+		condition += " AND `courses`.`term_id` = ?"
+		args = append(args, termID)
+	}
+
 	condition += " ORDER BY `courses`.`code`"
 
 	var page int
@@ -962,6 +1450,19 @@ func (h *handlers) SearchCourses(c echo.Context) error {
 		res = res[:len(res)-1]
 	}
 
+	courseIDs := make([]string, 0, len(res))
+	for _, course := range res {
+		courseIDs = append(courseIDs, course.ID)
+	}
+	slots, err := getCourseSlots(h.DB, courseIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for i := range res {
+		res[i].Slots = slots[res[i].ID]
+	}
+
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -974,12 +1475,25 @@ type AddCourseRequest struct {
 	Period      int        `json:"period"`
 	DayOfWeek   DayOfWeek  `json:"day_of_week"`
 	Keywords    string     `json:"keywords"`
+	TermID      *string    `json:"term_id,omitempty"`
+	Capacity    *int       `json:"capacity,omitempty"`
+
+	RegistrationOpensAt  *time.Time `json:"registration_opens_at,omitempty"`
+	RegistrationClosesAt *time.Time `json:"registration_closes_at,omitempty"`
+	// 週に複数回開講する場合の時間割枠 (省略時は period と day_of_week の1枠)
+	Slots []CourseSlot `json:"slots,omitempty"`
+	// 共同担当などで同じ時間帯に担当する科目があっても登録する
+	AllowTeacherConflict bool `json:"allow_teacher_conflict,omitempty"`
 }
 
 type AddCourseResponse struct {
 	ID string `json:"id"`
 }
 
+type AddCourseConflictResponse struct {
+	TeacherScheduleConflict []string `json:"teacher_schedule_conflict"`
+}
+
 // AddCourse POST /api/courses 新規科目登録
 func (h *handlers) AddCourse(c echo.Context) error {
 	userID, _, _, _, err := getUserInfo(c)
@@ -996,21 +1510,81 @@ func (h *handlers) AddCourse(c echo.Context) error {
 	if req.Type != LiberalArts && req.Type != MajorSubjects {
 		return c.String(http.StatusBadRequest, "Invalid course type.")
 	}
-	if !contains(daysOfWeek, req.DayOfWeek) {
-		return c.String(http.StatusBadRequest, "Invalid day of week.")
+	if len(req.Slots) == 0 {
+		if req.Period <= 0 || req.Period > math.MaxUint8 {
+			return c.String(http.StatusBadRequest, "Invalid period.")
+		}
+		req.Slots = []CourseSlot{{DayOfWeek: req.DayOfWeek, Period: uint8(req.Period)}}
+	}
+	for _, slot := range req.Slots {
+		if !contains(daysOfWeek, slot.DayOfWeek) {
+			return c.String(http.StatusBadRequest, "Invalid day of week.")
+		}
+		if slot.Period == 0 {
+			return c.String(http.StatusBadRequest, "Invalid period.")
+		}
+	}
+	req.Slots = normalizeCourseSlots(req.Slots)
+	req.DayOfWeek = req.Slots[0].DayOfWeek
+	req.Period = int(req.Slots[0].Period)
+	if req.Capacity != nil && *req.Capacity <= 0 {
+		return c.String(http.StatusBadRequest, "Invalid capacity.")
+	}
+	if !(RegistrationWindow{OpensAt: req.RegistrationOpensAt, ClosesAt: req.RegistrationClosesAt}).valid() {
+		return c.String(http.StatusBadRequest, "Invalid registration window.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	if req.TermID != nil {
+		if _, err := getTerm(tx, *req.TermID); err != nil && err != sql.ErrNoRows {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		} else if err == sql.ErrNoRows {
+			return c.String(http.StatusBadRequest, "No such term.")
+		}
+	}
+
+	// 教員が同じ学期の同じ時間帯に他の科目を担当していないか
+	// 同じ教員の科目登録が同時に確認を通過しないよう、教員の行をロックして直列化する
+	if !req.AllowTeacherConflict {
+		if _, err := tx.Exec("SELECT 1 FROM `users` WHERE `id` = ? FOR UPDATE", userID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		conflicts, err := teacherScheduleConflicts(tx, userID, req.Code, req.TermID, req.Slots, time.Now())
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if len(conflicts) > 0 {
+			return c.JSON(http.StatusConflict, AddCourseConflictResponse{TeacherScheduleConflict: conflicts})
+		}
 	}
 
 	courseID := newULID()
-	_, err = h.DB.Exec("INSERT INTO `courses` (`id`, `code`, `type`, `name`, `description`, `credit`, `period`, `day_of_week`, `teacher_id`, `keywords`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		courseID, req.Code, req.Type, req.Name, req.Description, req.Credit, req.Period, req.DayOfWeek, userID, req.Keywords)
+	_, err = tx.Exec("INSERT INTO `courses` (`id`, `code`, `type`, `name`, `description`, `credit`, `period`, `day_of_week`, `teacher_id`, `keywords`, `term_id`, `capacity`, `registration_opens_at`, `registration_closes_at`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		courseID, req.Code, req.Type, req.Name, req.Description, req.Credit, req.Period, req.DayOfWeek, userID, req.Keywords, req.TermID, req.Capacity, req.RegistrationOpensAt, req.RegistrationClosesAt)
 	if err != nil {
+		_ = tx.Rollback()
 		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
 			var course Course
 			if err := h.DB.Get(&course, "SELECT * FROM `courses` WHERE `code` = ?", req.Code); err != nil {
 				c.Logger().Error(err)
 				return c.NoContent(http.StatusInternalServerError)
 			}
-			if req.Type != course.Type || req.Name != course.Name || req.Description != course.Description || req.Credit != int(course.Credit) || req.Period != int(course.Period) || req.DayOfWeek != course.DayOfWeek || req.Keywords != course.Keywords {
+			slots, err := getCourseSlots(h.DB, []string{course.ID})
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			if req.Type != course.Type || req.Name != course.Name || req.Description != course.Description || req.Credit != int(course.Credit) || !equalCourseSlots(req.Slots, slots[course.ID]) || req.Keywords != course.Keywords || termKey(req.TermID) != termKey(course.TermID) || !equalIntPtr(req.Capacity, course.Capacity) ||
+				!equalTimePtr(req.RegistrationOpensAt, course.RegistrationOpensAt) || !equalTimePtr(req.RegistrationClosesAt, course.RegistrationClosesAt) {
 				return c.String(http.StatusConflict, "A course with the same code already exists.")
 			}
 			return c.JSON(http.StatusCreated, AddCourseResponse{ID: course.ID})
@@ -1018,6 +1592,21 @@ func (h *handlers) AddCourse(c echo.Context) error {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+
+	if err := insertCourseSlots(tx, courseID, req.Slots); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := writeAuditLog(c, tx, AuditEntry{Action: AuditAddCourse, CourseID: courseID, After: req}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 	c.Response().Header().Set("Cache-Control", "max-age=60")
 	return c.JSON(http.StatusCreated, AddCourseResponse{ID: courseID})
 }
@@ -1034,7 +1623,16 @@ type GetCourseDetailResponse struct {
 	TeacherID   string       `json:"-" db:"teacher_id"`
 	Keywords    string       `json:"keywords" db:"keywords"`
 	Status      CourseStatus `json:"status" db:"status"`
+	TermID      *string      `json:"term_id,omitempty" db:"term_id"`
+	Capacity    *int         `json:"capacity,omitempty" db:"capacity"`
+	StartedAt   sql.NullTime `json:"-" db:"started_at"`
 	Teacher     string       `json:"teacher" db:"teacher"`
+	Slots       []CourseSlot `json:"slots" db:"-"`
+
+	RegistrationOpensAt  *time.Time `json:"registration_opens_at,omitempty" db:"registration_opens_at"`
+	RegistrationClosesAt *time.Time `json:"registration_closes_at,omitempty" db:"registration_closes_at"`
+	// 科目詳細でのみ返す
+	Prerequisites []CoursePrerequisite `json:"prerequisites,omitempty" db:"-"`
 }
 
 // GetCourseDetail GET /api/courses/:courseID 科目詳細の取得
@@ -1053,6 +1651,20 @@ func (h *handlers) GetCourseDetail(c echo.Context) error {
 		return c.String(http.StatusNotFound, "No such course.")
 	}
 
+	slots, err := getCourseSlots(h.DB, []string{courseID})
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res.Slots = slots[courseID]
+
+	prerequisites, err := getCoursePrerequisites(h.DB, courseID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res.Prerequisites = prerequisites
+
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -1088,6 +1700,23 @@ func (h *handlers) SetCourseStatus(c echo.Context) error {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	// 履修取り消しの猶予期間の起点として開講日時を記録する
+	if req.Status == StatusInProgress && !course.StartedAt.Valid {
+		course.StartedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		if _, err := tx.Exec("UPDATE `courses` SET `started_at` = ? WHERE `id` = ?", course.StartedAt.Time, courseID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action:   AuditSetCourseStatus,
+		CourseID: courseID,
+		Before:   SetCourseStatusRequest{Status: course.Status},
+		After:    req,
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 	course.Status = req.Status
 	courseCache.Store(courseID, course)
 
@@ -1221,6 +1850,11 @@ func (h *handlers) AddClass(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	if err := writeAuditLog(c, tx, AuditEntry{Action: AuditAddClass, CourseID: courseID, ClassID: classID, After: req}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	if err := tx.Commit(); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -1372,7 +2006,30 @@ func (h *handlers) RegisterScores(c echo.Context) error {
 		userCodeMap[uc.Code] = uc.ID
 	}
 
+	// 監査ログ用に更新前の点数を取得
+	var previousScores []struct {
+		UserCode string `db:"user_code"`
+		Score    *int   `db:"score"`
+	}
+	psq, args, err := sqlx.In("SELECT `users`.`code` AS `user_code`, `submissions`.`score`"+
+		" FROM `submissions` JOIN `users` ON `submissions`.`user_id` = `users`.`id`"+
+		" WHERE `submissions`.`class_id` = ? AND `users`.`code` IN (?)", classID, userCodes)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := tx.Select(&previousScores, psq, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	before := make(map[string]*int, len(previousScores))
+	for _, ps := range previousScores {
+		before[ps.UserCode] = ps.Score
+	}
+	after := make(map[string]int, len(req))
+
 	for _, score := range req {
+		after[score.UserCode] = score.Score
 		userID := userCodeMap[score.UserCode]
 		if _, err := tx.Exec("UPDATE `submissions` SET `score` = ? WHERE `user_id` = ? AND `class_id` = ?", score.Score, userID, classID); err != nil {
 			c.Logger().Error(err)
@@ -1380,6 +2037,17 @@ func (h *handlers) RegisterScores(c echo.Context) error {
 		}
 	}
 
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action:   AuditRegisterScores,
+		CourseID: c.Param("courseID"),
+		ClassID:  classID,
+		Before:   before,
+		After:    after,
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	if err := tx.Commit(); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -1405,12 +2073,11 @@ func (h *handlers) DownloadSubmittedAssignments(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var classCount int
-	if err := tx.Get(&classCount, "SELECT COUNT(*) FROM `classes` WHERE `id` = ? FOR UPDATE", classID); err != nil {
+	var submissionClosed bool
+	if err := tx.Get(&submissionClosed, "SELECT `submission_closed` FROM `classes` WHERE `id` = ? FOR UPDATE", classID); err != nil && err != sql.ErrNoRows {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
-	}
-	if classCount == 0 {
+	} else if err == sql.ErrNoRows {
 		return c.String(http.StatusNotFound, "No such class.")
 	}
 	var submissions []Submission
@@ -1427,6 +2094,16 @@ func (h *handlers) DownloadSubmittedAssignments(c echo.Context) error {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action:   AuditCloseSubmissions,
+		CourseID: c.Param("courseID"),
+		ClassID:  classID,
+		Before:   map[string]interface{}{"submission_closed": submissionClosed},
+		After:    map[string]interface{}{"submission_closed": true, "submissions": len(submissions)},
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
 	if err := tx.Commit(); err != nil {
 		c.Logger().Error(err)
@@ -1521,6 +2198,10 @@ func (h *handlers) GetAnnouncementList(c echo.Context) error {
 		}
 	}
 
+	// 個人宛てのお知らせは宛先の学生にだけ表示する
+	query += " AND (`announcements`.`recipient_id` IS NULL OR `announcements`.`recipient_id` = ?)"
+	args = append(args, userID)
+
 	query += " ORDER BY `announcements`.`id` DESC LIMIT ? OFFSET ?"
 	var page int
 	if c.QueryParam("page") == "" {
@@ -1643,6 +2324,12 @@ type AddAnnouncementRequest struct {
 
 // AddAnnouncement POST /api/announcements 新規お知らせ追加
 func (h *handlers) AddAnnouncement(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	var req AddAnnouncementRequest
 	if err := c.Bind(&req); err != nil {
 		return c.String(http.StatusBadRequest, "Invalid format.")
@@ -1664,6 +2351,13 @@ func (h *handlers) AddAnnouncement(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	if ok, err := h.hasCoursePermission(req.CourseID, userID, PermAnnounce); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if !ok {
+		return c.String(http.StatusForbidden, "You do not have permission to perform this operation.")
+	}
+
 	if _, err := tx.Exec("INSERT INTO `announcements` (`id`, `course_id`, `course_name`, `title`, `message`) VALUES (?, ?, ?, ?, ?)",
 		req.ID, req.CourseID, courseName, req.Title, req.Message); err != nil {
 		_ = tx.Rollback()
@@ -1682,6 +2376,11 @@ func (h *handlers) AddAnnouncement(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	if err := writeAuditLog(c, tx, AuditEntry{Action: AuditAddAnnouncement, CourseID: req.CourseID, AnnouncementID: req.ID, After: req}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	userIDs, err := h.Redis.SMembers(context.TODO(), "registrations:"+req.CourseID).Result()
 	if err != nil {
 		c.Logger().Error(err)
@@ -1717,6 +2416,8 @@ type AnnouncementDetail struct {
 	Title      string `json:"title" db:"title"`
 	Message    string `json:"message" db:"message"`
 	Unread     bool   `json:"unread" db:"unread"`
+	// 個人宛てのお知らせの宛先 (空なら履修者全員)
+	RecipientID string `json:"-" db:"recipient_id"`
 }
 
 var annoucementsMap = sync.Map{} // map[string]AnnouncementDetail{}
@@ -1740,20 +2441,28 @@ func (h *handlers) GetAnnouncementDetail(c echo.Context) error {
 	//if cnt, _ := result.RowsAffected(); cnt == 1 {
 	//	unread = true
 	//}
-	var unreadCount int64
-	if unreadCount, err = h.Redis.SRem(context.TODO(), "unread_announcements:"+userID, announcementID).Result(); err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	if unreadCount == 1 {
-		unread = true
+	if isImpersonating(c) {
+		// 代理閲覧では既読にしない
+		if unread, err = h.Redis.SIsMember(context.TODO(), "unread_announcements:"+userID, announcementID).Result(); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	} else {
+		var unreadCount int64
+		if unreadCount, err = h.Redis.SRem(context.TODO(), "unread_announcements:"+userID, announcementID).Result(); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if unreadCount == 1 {
+			unread = true
+		}
 	}
 
 	var announcement AnnouncementDetail
 	if _ann, ok := annoucementsMap.Load(announcementID); ok {
 		announcement = _ann.(AnnouncementDetail)
 	} else {
-		query := "SELECT `announcements`.`id`, `announcements`.`course_id` AS `course_id`, `announcements`.`course_name`, `announcements`.`title`, `announcements`.`message`, true AS `unread`" +
+		query := "SELECT `announcements`.`id`, `announcements`.`course_id` AS `course_id`, `announcements`.`course_name`, `announcements`.`title`, `announcements`.`message`, true AS `unread`, IFNULL(`announcements`.`recipient_id`, '') AS `recipient_id`" +
 			" FROM `announcements`" +
 			" WHERE `announcements`.`id` = ?"
 		if err := h.DB.Get(&announcement, query, announcementID); err != nil && err != sql.ErrNoRows {
@@ -1771,7 +2480,7 @@ func (h *handlers) GetAnnouncementDetail(c echo.Context) error {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	if registrationCount == 0 {
+	if registrationCount == 0 || (announcement.RecipientID != "" && announcement.RecipientID != userID) {
 		return c.String(http.StatusNotFound, "No such announcement.")
 	}
 
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// パスワードポリシー
+var (
+	passwordMinLength      = GetEnvInt("PASSWORD_MIN_LENGTH", 8)
+	passwordRequireLetters = GetEnv("PASSWORD_REQUIRE_LETTERS", "true") == "true"
+	passwordRequireDigits  = GetEnv("PASSWORD_REQUIRE_DIGITS", "true") == "true"
+	bcryptCost             = GetEnvInt("BCRYPT_COST", bcrypt.DefaultCost)
+)
+
+// bcryptは72バイトより後ろを無視する
+const passwordMaxLength = 72
+
+func validatePassword(password string) error {
+	if len(password) < passwordMinLength {
+		return fmt.Errorf("Password must be at least %d characters.", passwordMinLength)
+	}
+	if len(password) > passwordMaxLength {
+		return fmt.Errorf("Password must be at most %d bytes.", passwordMaxLength)
+	}
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		if unicode.IsLetter(r) {
+			hasLetter = true
+		} else if unicode.IsDigit(r) {
+			hasDigit = true
+		}
+	}
+	if passwordRequireLetters && !hasLetter {
+		return errors.New("Password must contain a letter.")
+	}
+	if passwordRequireDigits && !hasDigit {
+		return errors.New("Password must contain a digit.")
+	}
+	return nil
+}
+
+func hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+}
+
+// needsRehash 現在の設定より低いコストでハッシュ化されているか
+func needsRehash(hashedPassword []byte) bool {
+	cost, err := bcrypt.Cost(hashedPassword)
+	return err == nil && cost < bcryptCost
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword PUT /api/users/me/password パスワード変更
+func (h *handlers) ChangePassword(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req ChangePasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	var hashedPassword []byte
+	if err := h.DB.Get(&hashedPassword, "SELECT `hashed_password` FROM `users` WHERE `id` = ?", userID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusUnauthorized, "You are not logged in.")
+	}
+	if bcrypt.CompareHashAndPassword(hashedPassword, []byte(req.CurrentPassword)) != nil {
+		return c.String(http.StatusBadRequest, "Current password is wrong.")
+	}
+	if req.NewPassword == req.CurrentPassword {
+		return c.String(http.StatusBadRequest, "New password must be different from the current one.")
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	newHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := h.DB.Exec("UPDATE `users` SET `hashed_password` = ? WHERE `id` = ?", newHash, userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 他の端末のセッションを無効化し、このリクエストのセッションだけ新しいIDで発行し直す
+	ctx := c.Request().Context()
+	if err := h.Sessions.RevokeUserSessions(ctx, userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	sess.ID = ""
+	sess.Options = &sessions.Options{
+		Path:   "/",
+		MaxAge: 3600,
+	}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// パスワードリセット
+//
+// トークンはハッシュをキーとしてRedisに保存し、一度使うか有効期限が切れると無効になる。
+// ユーザー毎に有効なトークンは最後に発行した1つだけとする。
+const (
+	passwordResetKeyPrefix         = "password_reset:"
+	passwordResetUserKeyPrefix     = "password_reset_user:"
+	passwordResetCooldownKeyPrefix = "password_reset_cooldown:"
+	passwordResetIPKeyPrefix       = "password_reset_ip:"
+)
+
+var (
+	passwordResetTTL = time.Duration(GetEnvInt("PASSWORD_RESET_TTL_MIN", 30)) * time.Minute
+	passwordResetURL = GetEnv("PASSWORD_RESET_URL", "https://localhost/password-reset?token=")
+
+	// 再設定メールの送信制限: ユーザーコード毎の再送間隔とIP毎の一定時間内の受付回数
+	passwordResetCooldown = time.Duration(GetEnvInt("PASSWORD_RESET_COOLDOWN_SEC", 60)) * time.Second
+	passwordResetIPLimit  = GetEnvInt("PASSWORD_RESET_IP_LIMIT", 20)
+	passwordResetIPWindow = time.Duration(GetEnvInt("PASSWORD_RESET_IP_WINDOW_SEC", 3600)) * time.Second
+)
+
+// throttlePasswordReset IP毎の受付回数を数え、上限を超えていれば解除までの残り時間を返す
+func (h *handlers) throttlePasswordReset(ctx context.Context, ip string) (time.Duration, error) {
+	key := passwordResetIPKeyPrefix + ip
+	n, err := h.Redis.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if n == 1 {
+		if err := h.Redis.Expire(ctx, key, passwordResetIPWindow).Err(); err != nil {
+			return 0, err
+		}
+	}
+	if int(n) <= passwordResetIPLimit {
+		return 0, nil
+	}
+	ttl, err := h.Redis.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		ttl = passwordResetIPWindow
+	}
+	return ttl, nil
+}
+
+type PasswordResetRequest struct {
+	Code string `json:"code"`
+}
+
+// RequestPasswordReset POST /password-reset パスワードリセットの申請
+// ユーザーの存在有無を推測されないよう、常に202を返す
+func (h *handlers) RequestPasswordReset(c echo.Context) error {
+	var req PasswordResetRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	ctx := c.Request().Context()
+	if retryAfter, err := h.throttlePasswordReset(ctx, c.RealIP()); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if retryAfter > 0 {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+		return c.String(http.StatusTooManyRequests, "Too many password reset requests. Please try again later.")
+	}
+	// 同じユーザーコードへの再送は一定時間受け付けない
+	// ユーザーの存在が分からないよう、存在しないコードでも同じく202を返す
+	if ok, err := h.Redis.SetNX(ctx, passwordResetCooldownKeyPrefix+req.Code, 1, passwordResetCooldown).Result(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if !ok {
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	var user User
+	if err := h.DB.Get(&user, "SELECT * FROM `users` WHERE `code` = ?", req.Code); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows || user.Status != UserActive {
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	tokenHash := base64.RawURLEncoding.EncodeToString(hashAPIToken(token))
+
+	if oldHash, err := h.Redis.Get(ctx, passwordResetUserKeyPrefix+user.ID).Result(); err != nil && err != redis.Nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == nil {
+		if err := h.Redis.Del(ctx, passwordResetKeyPrefix+oldHash).Err(); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	pipe := h.Redis.TxPipeline()
+	pipe.Set(ctx, passwordResetKeyPrefix+tokenHash, user.ID, passwordResetTTL)
+	pipe.Set(ctx, passwordResetUserKeyPrefix+user.ID, tokenHash, passwordResetTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := h.Mailer.Send(ctx, Mail{
+		To:      mailAddress(user.Code),
+		Subject: "パスワードの再設定",
+		Body: fmt.Sprintf("%s さん\n\n以下のURLから%d分以内にパスワードを再設定してください。\n%s%s\n\n心当たりがない場合はこのメールを破棄してください。\n",
+			user.Name, int(passwordResetTTL/time.Minute), passwordResetURL, token),
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+type ConfirmPasswordResetRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// ConfirmPasswordReset POST /password-reset/confirm パスワードの再設定
+func (h *handlers) ConfirmPasswordReset(c echo.Context) error {
+	var req ConfirmPasswordResetRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	ctx := c.Request().Context()
+	tokenHash := base64.RawURLEncoding.EncodeToString(hashAPIToken(req.Token))
+	pipe := h.Redis.TxPipeline()
+	get := pipe.Get(ctx, passwordResetKeyPrefix+tokenHash)
+	pipe.Del(ctx, passwordResetKeyPrefix+tokenHash)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	userID, err := get.Result()
+	if err == redis.Nil {
+		return c.String(http.StatusBadRequest, "Invalid or expired token.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var code string
+	if err := h.DB.Get(&code, "SELECT `code` FROM `users` WHERE `id` = ?", userID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusBadRequest, "Invalid or expired token.")
+	}
+
+	newHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := h.DB.Exec("UPDATE `users` SET `hashed_password` = ? WHERE `id` = ?", newHash, userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := h.Redis.Del(ctx, passwordResetUserKeyPrefix+userID).Err(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := h.Sessions.RevokeUserSessions(ctx, userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := h.resetLoginFailures(ctx, code); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ---------- Prerequisites ----------
+
+// 履修条件: 前提科目を修了(closed)しており、その科目の合計点が min_total_score 以上であること
+
+const defaultPrerequisiteMinTotalScore = 60
+
+type CoursePrerequisite struct {
+	ID            string `json:"id" db:"id"`
+	Code          string `json:"code" db:"code"`
+	Name          string `json:"name" db:"name"`
+	MinTotalScore int    `json:"min_total_score" db:"min_total_score"`
+}
+
+func getCoursePrerequisites(q sqlx.Queryer, courseID string) ([]CoursePrerequisite, error) {
+	prerequisites := make([]CoursePrerequisite, 0)
+	query := "SELECT `courses`.`id`, `courses`.`code`, `courses`.`name`, `course_prerequisites`.`min_total_score`" +
+		" FROM `course_prerequisites`" +
+		" JOIN `courses` ON `course_prerequisites`.`prerequisite_id` = `courses`.`id`" +
+		" WHERE `course_prerequisites`.`course_id` = ?" +
+		" ORDER BY `courses`.`code`"
+	if err := sqlx.Select(q, &prerequisites, query, courseID); err != nil {
+		return nil, err
+	}
+	return prerequisites, nil
+}
+
+// meetsPrerequisites 学生が科目の履修条件を全て満たしているか
+func meetsPrerequisites(q sqlx.Queryer, courseID, userID string) (bool, error) {
+	var unmet int
+	query := "SELECT COUNT(*)" +
+		" FROM `course_prerequisites`" +
+		" WHERE `course_prerequisites`.`course_id` = ?" +
+		" AND NOT EXISTS (" +
+		"   SELECT 1 FROM `registrations`" +
+		"   JOIN `courses` ON `registrations`.`course_id` = `courses`.`id` AND `courses`.`status` = ?" +
+		"   WHERE `registrations`.`user_id` = ? AND `registrations`.`course_id` = `course_prerequisites`.`prerequisite_id`" +
+		"   AND (" +
+		"     SELECT IFNULL(SUM(`submissions`.`score`), 0)" +
+		"     FROM `classes`" +
+		"     JOIN `submissions` ON `classes`.`id` = `submissions`.`class_id` AND `submissions`.`user_id` = `registrations`.`user_id`" +
+		"     WHERE `classes`.`course_id` = `registrations`.`course_id`" +
+		"   ) >= `course_prerequisites`.`min_total_score`" +
+		" )"
+	if err := sqlx.Get(q, &unmet, query, courseID, StatusClosed, userID); err != nil {
+		return false, err
+	}
+	return unmet == 0, nil
+}
+
+// requiresCourse courseID の科目が(間接的にでも) prerequisiteID を前提としているか
+func requiresCourse(q sqlx.Queryer, courseID, prerequisiteID string) (bool, error) {
+	visited := map[string]bool{courseID: true}
+	queue := []string{courseID}
+	for len(queue) > 0 {
+		var next []string
+		if err := sqlx.Select(q, &next, "SELECT `prerequisite_id` FROM `course_prerequisites` WHERE `course_id` = ?", queue[0]); err != nil {
+			return false, err
+		}
+		queue = queue[1:]
+		for _, id := range next {
+			if id == prerequisiteID {
+				return true, nil
+			}
+			if !visited[id] {
+				visited[id] = true
+				queue = append(queue, id)
+			}
+		}
+	}
+	return false, nil
+}
+
+// GetCoursePrerequisites GET /api/courses/:courseID/prerequisites 科目の履修条件の取得
+func (h *handlers) GetCoursePrerequisites(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var count int
+	if err := h.DB.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ?", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	res, err := getCoursePrerequisites(h.DB, courseID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+type SetCoursePrerequisiteRequest struct {
+	MinTotalScore *int `json:"min_total_score"`
+}
+
+// SetCoursePrerequisite PUT /api/courses/:courseID/prerequisites/:prerequisiteID 履修条件の追加・変更
+func (h *handlers) SetCoursePrerequisite(c echo.Context) error {
+	courseID := c.Param("courseID")
+	prerequisiteID := c.Param("prerequisiteID")
+
+	var req SetCoursePrerequisiteRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	minTotalScore := defaultPrerequisiteMinTotalScore
+	if req.MinTotalScore != nil {
+		minTotalScore = *req.MinTotalScore
+	}
+	if minTotalScore < 0 {
+		return c.String(http.StatusBadRequest, "Invalid minimum total score.")
+	}
+	if courseID == prerequisiteID {
+		return c.String(http.StatusBadRequest, "A course cannot be its own prerequisite.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM `courses` WHERE `id` = ?", prerequisiteID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "No such prerequisite course.")
+	}
+
+	if cyclic, err := requiresCourse(tx, prerequisiteID, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if cyclic {
+		return c.String(http.StatusBadRequest, "The prerequisite course already requires this course.")
+	}
+
+	var before *int
+	if err := tx.Get(&before, "SELECT `min_total_score` FROM `course_prerequisites` WHERE `course_id` = ? AND `prerequisite_id` = ? FOR UPDATE", courseID, prerequisiteID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if _, err := tx.Exec("INSERT INTO `course_prerequisites` (`course_id`, `prerequisite_id`, `min_total_score`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `min_total_score` = VALUES(`min_total_score`)",
+		courseID, prerequisiteID, minTotalScore); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var beforeEntry interface{}
+	if before != nil {
+		beforeEntry = SetCoursePrerequisiteRequest{MinTotalScore: before}
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action:   AuditSetPrerequisite,
+		CourseID: courseID,
+		Before:   beforeEntry,
+		After:    map[string]interface{}{"prerequisite_id": prerequisiteID, "min_total_score": minTotalScore},
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RemoveCoursePrerequisite DELETE /api/courses/:courseID/prerequisites/:prerequisiteID 履修条件の削除
+func (h *handlers) RemoveCoursePrerequisite(c echo.Context) error {
+	courseID := c.Param("courseID")
+	prerequisiteID := c.Param("prerequisiteID")
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var minTotalScore int
+	if err := tx.Get(&minTotalScore, "SELECT `min_total_score` FROM `course_prerequisites` WHERE `course_id` = ? AND `prerequisite_id` = ? FOR UPDATE", courseID, prerequisiteID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such prerequisite.")
+	}
+
+	if _, err := tx.Exec("DELETE FROM `course_prerequisites` WHERE `course_id` = ? AND `prerequisite_id` = ?", courseID, prerequisiteID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action:   AuditRemovePrerequisite,
+		CourseID: courseID,
+		Before:   map[string]interface{}{"prerequisite_id": prerequisiteID, "min_total_score": minTotalScore},
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
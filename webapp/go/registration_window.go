@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ---------- Registration Window ----------
+
+// 履修登録期間
+// 科目毎の期間 (courses.registration_opens_at / registration_closes_at) が設定されていればそれを、
+// なければ学期の期間 (terms.registration_opens_at / registration_closes_at) を使う。
+// どちらも未設定なら status が registration の間は登録できる。
+// 期間の終了した科目はスケジューラが in-progress に切り替える。
+
+var registrationSchedulerInterval = time.Duration(GetEnvInt("REGISTRATION_SCHEDULER_INTERVAL_SEC", 10)) * time.Second
+
+type RegistrationWindow struct {
+	OpensAt  *time.Time `json:"opens_at" db:"opens_at"`
+	ClosesAt *time.Time `json:"closes_at" db:"closes_at"`
+}
+
+// contains 期間内か (未設定の端は制限なし)
+func (w RegistrationWindow) contains(t time.Time) bool {
+	if w.OpensAt != nil && t.Before(*w.OpensAt) {
+		return false
+	}
+	if w.ClosesAt != nil && !t.Before(*w.ClosesAt) {
+		return false
+	}
+	return true
+}
+
+func (w RegistrationWindow) valid() bool {
+	return w.OpensAt == nil || w.ClosesAt == nil || w.OpensAt.Before(*w.ClosesAt)
+}
+
+// courseRegistrationWindow 科目に適用される履修登録期間
+func courseRegistrationWindow(course Course, termWindow RegistrationWindow) RegistrationWindow {
+	if course.RegistrationOpensAt != nil || course.RegistrationClosesAt != nil {
+		return RegistrationWindow{OpensAt: course.RegistrationOpensAt, ClosesAt: course.RegistrationClosesAt}
+	}
+	return termWindow
+}
+
+// SetCourseRegistrationWindow PUT /api/courses/:courseID/registration-window 科目毎の履修登録期間の設定
+// 開始・終了とも null にすると学期の期間に従う
+func (h *handlers) SetCourseRegistrationWindow(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var req RegistrationWindow
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if !req.valid() {
+		return c.String(http.StatusBadRequest, "Invalid registration window.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	if _, err := tx.Exec("UPDATE `courses` SET `registration_opens_at` = ?, `registration_closes_at` = ? WHERE `id` = ?", req.OpensAt, req.ClosesAt, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action:   AuditSetRegistrationWindow,
+		CourseID: courseID,
+		Before:   RegistrationWindow{OpensAt: course.RegistrationOpensAt, ClosesAt: course.RegistrationClosesAt},
+		After:    req,
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	course.RegistrationOpensAt = req.OpensAt
+	course.RegistrationClosesAt = req.ClosesAt
+	courseCache.Store(courseID, course)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// closeEndedRegistrations 履修登録期間の終了した科目を in-progress に切り替える
+func (h *handlers) closeEndedRegistrations(ctx context.Context, now time.Time) ([]string, error) {
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var courseIDs []string
+	query := "SELECT `courses`.`id` FROM `courses`" +
+		" LEFT JOIN `terms` ON `courses`.`term_id` = `terms`.`id`" +
+		" WHERE `courses`.`status` = ?" +
+		" AND IF(`courses`.`registration_opens_at` IS NULL AND `courses`.`registration_closes_at` IS NULL," +
+		"   `terms`.`registration_closes_at`, `courses`.`registration_closes_at`) <= ?" +
+		" FOR UPDATE OF `courses`"
+	if err := tx.Select(&courseIDs, query, StatusRegistration, now); err != nil {
+		return nil, err
+	}
+	if len(courseIDs) == 0 {
+		return nil, nil
+	}
+
+	q, args, err := sqlx.In("UPDATE `courses` SET `status` = ?, `started_at` = IFNULL(`started_at`, ?) WHERE `id` IN (?)", StatusInProgress, now, courseIDs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(q, args...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, courseID := range courseIDs {
+		courseCache.Delete(courseID)
+	}
+	return courseIDs, nil
+}
+
+// runRegistrationScheduler 履修登録期間の終了を定期的に確認する
+func (h *handlers) runRegistrationScheduler(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(registrationSchedulerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			courseIDs, err := h.closeEndedRegistrations(ctx, now)
+			if err != nil {
+				logger.Error(err)
+				continue
+			}
+			if len(courseIDs) > 0 {
+				logger.Infof("registration closed for %d courses", len(courseIDs))
+			}
+		}
+	}
+}
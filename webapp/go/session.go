@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// セッションCookieの署名・暗号化鍵
+//
+// SESSION_SECRETS_FILE (1行1エントリ、#以降はコメント) もしくは
+// SESSION_SECRETS (カンマ区切り) で "hashKey" または "hashKey:blockKey" を列挙する。
+// 先頭のエントリで新しいCookieを署名し、2番目以降は既存Cookieの検証にのみ使う。
+// 鍵をローテーションするときは新しい鍵を先頭に追加し、古い鍵は全Cookieが
+// 失効した後 (最大でセッションのMaxAge後) にリストから削除して廃止する。
+// 鍵が未設定の場合は起動しない。開発時のみ SESSION_ALLOW_RANDOM_KEYS=true で
+// プロセス固有の鍵を使って起動できる。
+const (
+	sessionSecretsEnv         = "SESSION_SECRETS"
+	sessionSecretsFileEnv     = "SESSION_SECRETS_FILE"
+	sessionAllowRandomKeysEnv = "SESSION_ALLOW_RANDOM_KEYS"
+)
+
+var errNoSessionSecrets = errors.New("no session secrets configured: set " + sessionSecretsEnv + " or " + sessionSecretsFileEnv)
+
+func loadSessionKeyPairs() ([][]byte, error) {
+	var entries []string
+	if path := GetEnv(sessionSecretsFileEnv, ""); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			entries = append(entries, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		entries = strings.Split(GetEnv(sessionSecretsEnv, ""), ",")
+	}
+
+	var keyPairs [][]byte
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		hashKey, blockKey := entry, ""
+		if i := strings.Index(entry, ":"); i >= 0 {
+			hashKey, blockKey = entry[:i], entry[i+1:]
+		}
+		if len(hashKey) < 32 {
+			return nil, fmt.Errorf("session hash key must be at least 32 bytes: got %d bytes", len(hashKey))
+		}
+		switch len(blockKey) {
+		case 0, 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("session block key must be 16, 24 or 32 bytes: got %d bytes", len(blockKey))
+		}
+		var block []byte
+		if blockKey != "" {
+			block = []byte(blockKey)
+		}
+		keyPairs = append(keyPairs, []byte(hashKey), block)
+	}
+	if len(keyPairs) == 0 {
+		return nil, errNoSessionSecrets
+	}
+	return keyPairs, nil
+}
+
+// randomSessionKeyPairs 鍵が設定されていない場合に使うプロセス固有の鍵
+// 再起動やプロセス間でセッションは共有されない
+func randomSessionKeyPairs() ([][]byte, error) {
+	hashKey := make([]byte, 64)
+	blockKey := make([]byte, 32)
+	if _, err := rand.Read(hashKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(blockKey); err != nil {
+		return nil, err
+	}
+	return [][]byte{hashKey, blockKey}, nil
+}
+
+const (
+	sessionKeyPrefix      = "session:"
+	sessionMetaKeyPrefix  = "session_meta:"
+	userSessionsKeyPrefix = "user_sessions:"
+	defaultSessionMaxAge  = 3600
+)
+
+// RedisStore セッションの中身をRedisに保存するsessions.Store
+// Cookieには署名済みのセッションIDのみを載せる
+type RedisStore struct {
+	Client  *redis.Client
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func NewRedisStore(client *redis.Client, keyPairs ...[]byte) *RedisStore {
+	return &RedisStore{
+		Client: client,
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: defaultSessionMaxAge,
+		},
+	}
+}
+
+func (s *RedisStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New Cookieのセッションに対応する状態がRedisにあれば読み込む
+// Cookieが不正な場合や失効済みの場合は新しいセッションを返す
+func (s *RedisStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	sess := sessions.NewSession(s, name)
+	opts := *s.Options
+	sess.Options = &opts
+	sess.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return sess, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs...); err != nil {
+		return sess, nil
+	}
+	data, err := s.Client.Get(r.Context(), sessionKeyPrefix+id).Bytes()
+	if err == redis.Nil {
+		return sess, nil
+	} else if err != nil {
+		return sess, err
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &sess.Values); err != nil {
+		return sess, err
+	}
+	sess.ID = id
+	sess.IsNew = false
+	return sess, nil
+}
+
+// Save セッションをRedisに保存してCookieを発行する
+// MaxAgeが負の場合はRedisからも削除する
+func (s *RedisStore) Save(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
+	ctx := r.Context()
+	if sess.Options.MaxAge < 0 {
+		if sess.ID != "" {
+			if err := s.delete(ctx, sess.ID, sessionOwner(sess.Values)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(sess.Name(), "", sess.Options))
+		return nil
+	}
+
+	isNewID := sess.ID == ""
+	if isNewID {
+		sess.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	data, err := (securecookie.GobEncoder{}).Serialize(sess.Values)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(sess.Options.MaxAge) * time.Second
+	if sess.Options.MaxAge == 0 {
+		ttl = defaultSessionMaxAge * time.Second
+	}
+	pipe := s.Client.TxPipeline()
+	pipe.Set(ctx, sessionKeyPrefix+sess.ID, data, ttl)
+	if isNewID {
+		now := time.Now().UnixNano()
+		pipe.HSet(ctx, sessionMetaKeyPrefix+sess.ID, "created_at", now, "last_seen_at", now, "user_agent", r.UserAgent())
+	}
+	pipe.Expire(ctx, sessionMetaKeyPrefix+sess.ID, ttl)
+	if userID, ok := sessionOwner(sess.Values).(string); ok {
+		pipe.SAdd(ctx, userSessionsKeyPrefix+userID, sess.ID)
+		pipe.Expire(ctx, userSessionsKeyPrefix+userID, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(sess.Name(), sess.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(sess.Name(), encoded, sess.Options))
+	return nil
+}
+
+func (s *RedisStore) delete(ctx context.Context, id string, userID interface{}) error {
+	pipe := s.Client.TxPipeline()
+	pipe.Del(ctx, sessionKeyPrefix+id, sessionMetaKeyPrefix+id)
+	if userID, ok := userID.(string); ok {
+		pipe.SRem(ctx, userSessionsKeyPrefix+userID, id)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Touch セッションの最終アクセス日時を更新する
+func (s *RedisStore) Touch(ctx context.Context, id string) error {
+	if id == "" {
+		return nil
+	}
+	return s.Client.HSet(ctx, sessionMetaKeyPrefix+id, "last_seen_at", time.Now().UnixNano()).Err()
+}
+
+// RevokeUserSessions 指定したユーザーの全セッションを無効化する
+func (s *RedisStore) RevokeUserSessions(ctx context.Context, userID string) error {
+	return s.RevokeUserSessionsExcept(ctx, userID, "")
+}
+
+// RevokeUserSessionsExcept 指定したユーザーのkeepID以外の全セッションを無効化する
+func (s *RedisStore) RevokeUserSessionsExcept(ctx context.Context, userID, keepID string) error {
+	ids, err := s.Client.SMembers(ctx, userSessionsKeyPrefix+userID).Result()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(ids)*2)
+	var revoked []interface{}
+	for _, id := range ids {
+		if id == keepID {
+			continue
+		}
+		keys = append(keys, sessionKeyPrefix+id, sessionMetaKeyPrefix+id)
+		revoked = append(revoked, id)
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+	pipe := s.Client.TxPipeline()
+	pipe.Del(ctx, keys...)
+	pipe.SRem(ctx, userSessionsKeyPrefix+userID, revoked...)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// SessionInfo セッション一覧で返すセッションの情報
+// セッションIDそのものは返さず、そのハッシュを公開用のIDとして使う
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"`
+
+	sessionID string
+}
+
+func publicSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// ListUserSessions 指定したユーザーの有効なセッション一覧
+// 失効済みのセッションはユーザーのセッション集合から取り除く
+func (s *RedisStore) ListUserSessions(ctx context.Context, userID string) ([]SessionInfo, error) {
+	ids, err := s.Client.SMembers(ctx, userSessionsKeyPrefix+userID).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	infos := make([]SessionInfo, 0, len(ids))
+	var expired []interface{}
+	for _, id := range ids {
+		meta, err := s.Client.HGetAll(ctx, sessionMetaKeyPrefix+id).Result()
+		if err != nil {
+			return nil, err
+		}
+		if exists, err := s.Client.Exists(ctx, sessionKeyPrefix+id).Result(); err != nil {
+			return nil, err
+		} else if exists == 0 || len(meta) == 0 {
+			expired = append(expired, id)
+			continue
+		}
+		createdAt, _ := strconv.ParseInt(meta["created_at"], 10, 64)
+		lastSeenAt, _ := strconv.ParseInt(meta["last_seen_at"], 10, 64)
+		infos = append(infos, SessionInfo{
+			ID:         publicSessionID(id),
+			CreatedAt:  time.Unix(0, createdAt),
+			LastSeenAt: time.Unix(0, lastSeenAt),
+			UserAgent:  meta["user_agent"],
+			sessionID:  id,
+		})
+	}
+	if len(expired) > 0 {
+		if err := s.Client.SRem(ctx, userSessionsKeyPrefix+userID, expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// RevokeUserSessions DELETE /api/users/:userCode/sessions 指定ユーザーの全セッションを無効化
+func (h *handlers) RevokeUserSessions(c echo.Context) error {
+	userCode := c.Param("userCode")
+
+	var userID string
+	if err := h.DB.Get(&userID, "SELECT `id` FROM `users` WHERE `code` = ?", userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+
+	if err := h.Sessions.RevokeUserSessions(c.Request().Context(), userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// currentSessionID リクエストのセッションID (Bearerトークンで認証した場合は空文字)
+func currentSessionID(c echo.Context) (string, error) {
+	if _, ok := c.Get(tokenUserContextKey).(*tokenUser); ok {
+		return "", nil
+	}
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return "", err
+	}
+	return sess.ID, nil
+}
+
+// GetMySessions GET /api/users/me/sessions 有効なセッション一覧の取得
+func (h *handlers) GetMySessions(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	currentID, err := currentSessionID(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	infos, err := h.Sessions.ListUserSessions(c.Request().Context(), userID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for i := range infos {
+		infos[i].Current = infos[i].sessionID == currentID
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LastSeenAt.After(infos[j].LastSeenAt)
+	})
+
+	return c.JSON(http.StatusOK, infos)
+}
+
+// RevokeMySession DELETE /api/users/me/sessions/:sessionID 指定したセッションのログアウト
+func (h *handlers) RevokeMySession(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	ctx := c.Request().Context()
+	infos, err := h.Sessions.ListUserSessions(ctx, userID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for _, info := range infos {
+		if info.ID == c.Param("sessionID") {
+			if err := h.Sessions.delete(ctx, info.sessionID, userID); err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			return c.NoContent(http.StatusNoContent)
+		}
+	}
+
+	return c.String(http.StatusNotFound, "No such session.")
+}
+
+// RevokeMyOtherSessions DELETE /api/users/me/sessions 現在のセッション以外を全てログアウト
+func (h *handlers) RevokeMyOtherSessions(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	currentID, err := currentSessionID(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := h.Sessions.RevokeUserSessionsExcept(c.Request().Context(), userID, currentID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ---------- Terms ----------
+
+// 学期
+// 科目は学期に属し、時間割の重複と単位数の上限は同じ学期の科目の間で判定する。
+// 学期に属さない科目 (courses.term_id が NULL) は、学期に属さない科目同士で判定する。
+
+// 学期の開始日・終了日の形式
+const termDateLayout = "2006-01-02"
+
+type Term struct {
+	ID                   string     `json:"id" db:"id"`
+	Code                 string     `json:"code" db:"code"`
+	Name                 string     `json:"name" db:"name"`
+	StartsOn             string     `json:"starts_on" db:"starts_on"`
+	EndsOn               string     `json:"ends_on" db:"ends_on"`
+	RegistrationOpensAt  *time.Time `json:"registration_opens_at" db:"registration_opens_at"`
+	RegistrationClosesAt *time.Time `json:"registration_closes_at" db:"registration_closes_at"`
+}
+
+func (t Term) registrationWindow() RegistrationWindow {
+	return RegistrationWindow{OpensAt: t.RegistrationOpensAt, ClosesAt: t.RegistrationClosesAt}
+}
+
+// termKey 学期毎に集計する際のキー (学期に属さない科目は空文字)
+func termKey(termID *string) string {
+	if termID == nil {
+		return ""
+	}
+	return *termID
+}
+
+// sameTerm 2つの科目が同じ学期に属するか
+func sameTerm(a, b Course) bool {
+	return termKey(a.TermID) == termKey(b.TermID)
+}
+
+const termColumns = "`id`, `code`, `name`, DATE_FORMAT(`starts_on`, '%Y-%m-%d') AS `starts_on`, DATE_FORMAT(`ends_on`, '%Y-%m-%d') AS `ends_on`, `registration_opens_at`, `registration_closes_at`"
+
+func getTerm(q sqlx.Queryer, termID string) (Term, error) {
+	var term Term
+	err := sqlx.Get(q, &term, "SELECT "+termColumns+" FROM `terms` WHERE `id` = ?", termID)
+	return term, err
+}
+
+// termRegistrationWindows 科目の学期の履修登録期間をリクエスト内でまとめて引くためのキャッシュ
+type termRegistrationWindows struct {
+	q       sqlx.Queryer
+	windows map[string]RegistrationWindow
+}
+
+func newTermRegistrationWindows(q sqlx.Queryer) *termRegistrationWindows {
+	return &termRegistrationWindows{q: q, windows: map[string]RegistrationWindow{}}
+}
+
+// forCourse 科目の学期の履修登録期間 (学期に属さない科目は制限なし)
+func (w *termRegistrationWindows) forCourse(course Course) (RegistrationWindow, error) {
+	if course.TermID == nil {
+		return RegistrationWindow{}, nil
+	}
+	if window, ok := w.windows[*course.TermID]; ok {
+		return window, nil
+	}
+	term, err := getTerm(w.q, *course.TermID)
+	if err == sql.ErrNoRows {
+		return RegistrationWindow{}, nil
+	} else if err != nil {
+		return RegistrationWindow{}, err
+	}
+	w.windows[*course.TermID] = term.registrationWindow()
+	return w.windows[*course.TermID], nil
+}
+
+// GetTerms GET /api/terms 学期一覧の取得
+func (h *handlers) GetTerms(c echo.Context) error {
+	res := make([]Term, 0)
+	if err := h.DB.Select(&res, "SELECT "+termColumns+" FROM `terms` ORDER BY `starts_on` DESC"); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// GetTerm GET /api/terms/:termID 学期の取得
+func (h *handlers) GetTerm(c echo.Context) error {
+	term, err := getTerm(h.DB, c.Param("termID"))
+	if err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such term.")
+	}
+
+	return c.JSON(http.StatusOK, term)
+}
+
+type TermRequest struct {
+	Code                 string     `json:"code"`
+	Name                 string     `json:"name"`
+	StartsOn             string     `json:"starts_on"`
+	EndsOn               string     `json:"ends_on"`
+	RegistrationOpensAt  *time.Time `json:"registration_opens_at"`
+	RegistrationClosesAt *time.Time `json:"registration_closes_at"`
+}
+
+func (req TermRequest) validate() string {
+	if req.Code == "" || len(req.Code) > 32 {
+		return "Invalid term code."
+	}
+	if req.Name == "" || len(req.Name) > 255 {
+		return "Invalid term name."
+	}
+	startsOn, err := time.Parse(termDateLayout, req.StartsOn)
+	if err != nil {
+		return "Invalid start date."
+	}
+	endsOn, err := time.Parse(termDateLayout, req.EndsOn)
+	if err != nil || endsOn.Before(startsOn) {
+		return "Invalid end date."
+	}
+	if !(RegistrationWindow{OpensAt: req.RegistrationOpensAt, ClosesAt: req.RegistrationClosesAt}).valid() {
+		return "Invalid registration window."
+	}
+	return ""
+}
+
+type AddTermResponse struct {
+	ID string `json:"id"`
+}
+
+// AddTerm POST /api/terms 学期の追加
+func (h *handlers) AddTerm(c echo.Context) error {
+	var req TermRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if msg := req.validate(); msg != "" {
+		return c.String(http.StatusBadRequest, msg)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	termID := newULID()
+	if _, err := tx.Exec("INSERT INTO `terms` (`id`, `code`, `name`, `starts_on`, `ends_on`, `registration_opens_at`, `registration_closes_at`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		termID, req.Code, req.Name, req.StartsOn, req.EndsOn, req.RegistrationOpensAt, req.RegistrationClosesAt); err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+			return c.String(http.StatusConflict, "A term with the same code already exists.")
+		}
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{Action: AuditAddTerm, After: req}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, AddTermResponse{ID: termID})
+}
+
+// UpdateTerm PUT /api/terms/:termID 学期の変更 (履修登録期間を含む)
+func (h *handlers) UpdateTerm(c echo.Context) error {
+	termID := c.Param("termID")
+
+	var req TermRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if msg := req.validate(); msg != "" {
+		return c.String(http.StatusBadRequest, msg)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var before Term
+	if err := tx.Get(&before, "SELECT "+termColumns+" FROM `terms` WHERE `id` = ? FOR UPDATE", termID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such term.")
+	}
+
+	if _, err := tx.Exec("UPDATE `terms` SET `code` = ?, `name` = ?, `starts_on` = ?, `ends_on` = ?, `registration_opens_at` = ?, `registration_closes_at` = ? WHERE `id` = ?",
+		req.Code, req.Name, req.StartsOn, req.EndsOn, req.RegistrationOpensAt, req.RegistrationClosesAt, termID); err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+			return c.String(http.StatusConflict, "A term with the same code already exists.")
+		}
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{Action: AuditUpdateTerm, Before: before, After: req}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 個人用APIトークン
+//
+// Authorization: Bearer <token> で送られたトークンをIsLoggedInで検証する。
+// DBにはトークンのSHA-256ハッシュのみを保存し、平文は発行時に一度だけ返す。
+// Authorizationヘッダを送れないカレンダーアプリのため、時間割のiCalendarフィードに限り
+// calendar スコープのみのトークンを ?token= で受け付ける。
+
+type TokenScope string
+
+const (
+	// ScopeReadOnly 副作用のないGETリクエストのみ
+	ScopeReadOnly TokenScope = "read-only"
+	// ScopeScores 採点結果の登録と提出課題のダウンロードのみ
+	ScopeScores TokenScope = "scores"
+	// ScopeCalendar 時間割のiCalendarフィードの取得のみ
+	ScopeCalendar TokenScope = "calendar"
+)
+
+var tokenScopes = []TokenScope{ScopeReadOnly, ScopeScores, ScopeCalendar}
+
+const (
+	apiTokenPrefix       = "isu_"
+	tokenUserContextKey  = "tokenUser"
+	tokenScopeSeparator  = ","
+	exportAssignmentPath = "/api/courses/:courseID/classes/:classID/assignments/export"
+	scoresPath           = "/api/courses/:courseID/classes/:classID/assignments/scores"
+	calendarFeedPath     = "/api/users/me/courses.ics"
+)
+
+type APIToken struct {
+	ID         string       `db:"id"`
+	UserID     string       `db:"user_id"`
+	Name       string       `db:"name"`
+	TokenHash  []byte       `db:"token_hash"`
+	Scopes     string       `db:"scopes"`
+	CreatedAt  time.Time    `db:"created_at"`
+	LastUsedAt sql.NullTime `db:"last_used_at"`
+	ExpiresAt  sql.NullTime `db:"expires_at"`
+}
+
+// tokenUser Bearerトークンで認証したユーザー
+type tokenUser struct {
+	ID      string
+	Name    string
+	Code    string
+	IsAdmin bool
+	Scopes  []TokenScope
+}
+
+func hashAPIToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func newAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + strings.TrimRight(base32.StdEncoding.EncodeToString(b), "="), nil
+}
+
+func bearerToken(c echo.Context) (string, bool) {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return auth[len("Bearer "):], true
+	}
+	return "", false
+}
+
+// calendarFeedToken iCalendarフィードへのリクエストで ?token= に指定されたトークン
+func calendarFeedToken(c echo.Context) (string, bool) {
+	if c.Path() != calendarFeedPath {
+		return "", false
+	}
+	token := c.QueryParam("token")
+	return token, token != ""
+}
+
+// isCalendarOnly calendar スコープのみのトークンか
+func isCalendarOnly(scopes []TokenScope) bool {
+	return len(scopes) == 1 && scopes[0] == ScopeCalendar
+}
+
+func parseTokenScopes(s string) []TokenScope {
+	var scopes []TokenScope
+	for _, scope := range strings.Split(s, tokenScopeSeparator) {
+		if scope != "" {
+			scopes = append(scopes, TokenScope(scope))
+		}
+	}
+	return scopes
+}
+
+// tokenAllows スコープがリクエストを許可しているか
+// スコープが空のトークンは全てのAPIを利用できるが、トークン自体の管理とパスワード変更はセッションからのみ行える
+func tokenAllows(scopes []TokenScope, method, path string) bool {
+	if strings.HasPrefix(path, "/api/users/me/tokens") || path == "/api/users/me/password" || path == calendarSubscriptionPath {
+		return false
+	}
+	if len(scopes) == 0 {
+		return true
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeReadOnly:
+			// exportは提出を締め切るのでGETでも読み取り専用ではない
+			if (method == http.MethodGet || method == http.MethodHead) && path != exportAssignmentPath {
+				return true
+			}
+		case ScopeScores:
+			if path == scoresPath || path == exportAssignmentPath {
+				return true
+			}
+		case ScopeCalendar:
+			if (method == http.MethodGet || method == http.MethodHead) && path == calendarFeedPath {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authenticateToken Bearerトークンを検証し、認証したユーザーをcontextに保存する
+// 認証できなかった場合はレスポンスを書き込んでfalseを返す
+// inURL はトークンがURLで渡されたか (calendar スコープのみのトークンに限り許可する)
+func (h *handlers) authenticateToken(c echo.Context, token string, inURL bool) (bool, error) {
+	var row struct {
+		APIToken
+		UserName string   `db:"user_name"`
+		UserCode string   `db:"user_code"`
+		UserType UserType `db:"user_type"`
+	}
+	query := "SELECT `api_tokens`.*, `users`.`name` AS `user_name`, `users`.`code` AS `user_code`, `users`.`type` AS `user_type`" +
+		" FROM `api_tokens`" +
+		" JOIN `users` ON `api_tokens`.`user_id` = `users`.`id`" +
+		" WHERE `api_tokens`.`token_hash` = ? AND `users`.`status` = 'active'"
+	if err := h.DB.Get(&row, query, hashAPIToken(token)); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return false, c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return false, c.String(http.StatusUnauthorized, "Invalid token.")
+	}
+	now := time.Now()
+	if row.ExpiresAt.Valid && now.After(row.ExpiresAt.Time) {
+		return false, c.String(http.StatusUnauthorized, "Token has expired.")
+	}
+
+	scopes := parseTokenScopes(row.Scopes)
+	if inURL && !isCalendarOnly(scopes) {
+		return false, c.String(http.StatusForbidden, "Only calendar tokens can be passed in the URL.")
+	}
+	if !tokenAllows(scopes, c.Request().Method, c.Path()) {
+		return false, c.String(http.StatusForbidden, "This token is not allowed to access this API.")
+	}
+
+	if _, err := h.DB.Exec("UPDATE `api_tokens` SET `last_used_at` = ? WHERE `id` = ?", now, row.ID); err != nil {
+		c.Logger().Error(err)
+		return false, c.NoContent(http.StatusInternalServerError)
+	}
+
+	c.Set(tokenUserContextKey, &tokenUser{
+		ID:      row.UserID,
+		Name:    row.UserName,
+		Code:    row.UserCode,
+		IsAdmin: isAdminType(row.UserType),
+		Scopes:  scopes,
+	})
+	return true, nil
+}
+
+type CreateTokenRequest struct {
+	Name          string       `json:"name"`
+	Scopes        []TokenScope `json:"scopes"`
+	ExpiresInDays int          `json:"expires_in_days"`
+}
+
+type TokenResponse struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Scopes     []TokenScope `json:"scopes"`
+	CreatedAt  time.Time    `json:"created_at"`
+	LastUsedAt *time.Time   `json:"last_used_at"`
+	ExpiresAt  *time.Time   `json:"expires_at"`
+}
+
+type CreateTokenResponse struct {
+	TokenResponse
+	Token string `json:"token"`
+}
+
+func newTokenResponse(t APIToken) TokenResponse {
+	res := TokenResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scopes:    append(make([]TokenScope, 0), parseTokenScopes(t.Scopes)...),
+		CreatedAt: t.CreatedAt,
+	}
+	if t.LastUsedAt.Valid {
+		res.LastUsedAt = &t.LastUsedAt.Time
+	}
+	if t.ExpiresAt.Valid {
+		res.ExpiresAt = &t.ExpiresAt.Time
+	}
+	return res
+}
+
+// issueAPIToken APIトークンを発行して保存し、平文のトークンを返す
+func (h *handlers) issueAPIToken(userID, name string, scopes []string, expiresInDays int) (APIToken, string, error) {
+	token, err := newAPIToken()
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	t := APIToken{
+		ID:        newULID(),
+		UserID:    userID,
+		Name:      name,
+		TokenHash: hashAPIToken(token),
+		Scopes:    strings.Join(scopes, tokenScopeSeparator),
+		CreatedAt: time.Now().Truncate(time.Microsecond),
+	}
+	if expiresInDays > 0 {
+		t.ExpiresAt = sql.NullTime{Time: t.CreatedAt.AddDate(0, 0, expiresInDays), Valid: true}
+	}
+	if _, err := h.DB.Exec("INSERT INTO `api_tokens` (`id`, `user_id`, `name`, `token_hash`, `scopes`, `created_at`, `expires_at`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		t.ID, t.UserID, t.Name, t.TokenHash, t.Scopes, t.CreatedAt, t.ExpiresAt); err != nil {
+		return APIToken{}, "", err
+	}
+	return t, token, nil
+}
+
+// CreateToken POST /api/users/me/tokens APIトークンの発行
+func (h *handlers) CreateToken(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req CreateTokenRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if req.Name == "" || len(req.Name) > 255 {
+		return c.String(http.StatusBadRequest, "Invalid token name.")
+	}
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		if !containsTokenScope(tokenScopes, scope) {
+			return c.String(http.StatusBadRequest, "Invalid token scope.")
+		}
+		scopes = append(scopes, string(scope))
+	}
+	if req.ExpiresInDays < 0 {
+		return c.String(http.StatusBadRequest, "Invalid expiration.")
+	}
+
+	t, token, err := h.issueAPIToken(userID, req.Name, scopes, req.ExpiresInDays)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, CreateTokenResponse{
+		TokenResponse: newTokenResponse(t),
+		Token:         token,
+	})
+}
+
+// GetTokens GET /api/users/me/tokens 発行済みAPIトークン一覧の取得
+func (h *handlers) GetTokens(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var tokens []APIToken
+	if err := h.DB.Select(&tokens, "SELECT * FROM `api_tokens` WHERE `user_id` = ? ORDER BY `id`", userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 発行済みのトークンが0件の時は空配列を返却
+	res := make([]TokenResponse, 0, len(tokens))
+	for _, t := range tokens {
+		res = append(res, newTokenResponse(t))
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// RevokeToken DELETE /api/users/me/tokens/:tokenID APIトークンの失効
+func (h *handlers) RevokeToken(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	result, err := h.DB.Exec("DELETE FROM `api_tokens` WHERE `id` = ? AND `user_id` = ?", c.Param("tokenID"), userID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if cnt, _ := result.RowsAffected(); cnt == 0 {
+		return c.String(http.StatusNotFound, "No such token.")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ---------- User Management API ----------
+
+// UserStatus アカウントの状態
+// active 以外のユーザーはログインできず、APIトークンも使えない。
+// 既存のセッションは状態を変更した時点で全て破棄する (リクエスト毎には確認しない)。
+// 履修登録や提出物などのデータはそのまま残る。
+type UserStatus string
+
+const (
+	UserActive    UserStatus = "active"
+	UserSuspended UserStatus = "suspended"
+	UserGraduated UserStatus = "graduated"
+)
+
+var userStatuses = []UserStatus{UserActive, UserSuspended, UserGraduated}
+
+func isValidUserStatus(s UserStatus) bool {
+	for _, v := range userStatuses {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// inactiveUserMessage ログインできない状態のユーザーに返すメッセージ
+func inactiveUserMessage(status UserStatus) string {
+	if status == UserGraduated {
+		return "This account is no longer available because the user has graduated."
+	}
+	return "This account is suspended."
+}
+
+var userTypes = []UserType{Student, Teacher, Admin}
+
+// ユーザーコードは英大文字1文字と数字5桁 (users.code は CHAR(6))
+var userCodePattern = regexp.MustCompile(`^[A-Z][0-9]{5}$`)
+
+func isValidUserType(t UserType) bool {
+	for _, v := range userTypes {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// validateUserFields ユーザーの入力値を検証し、問題があればエラーメッセージを返す
+func validateUserFields(code, name string, userType UserType) string {
+	if !userCodePattern.MatchString(code) {
+		return "Invalid user code."
+	}
+	if name == "" || len(name) > 255 {
+		return "Invalid user name."
+	}
+	if !isValidUserType(userType) {
+		return "Invalid user type."
+	}
+	return ""
+}
+
+type UserResponse struct {
+	Code   string     `json:"code" db:"code"`
+	Name   string     `json:"name" db:"name"`
+	Type   UserType   `json:"type" db:"type"`
+	Status UserStatus `json:"status" db:"status"`
+}
+
+// GetUsers GET /api/users ユーザー一覧の取得
+func (h *handlers) GetUsers(c echo.Context) error {
+	query := "SELECT `code`, `name`, `type`, `status` FROM `users` WHERE 1=1"
+	var condition string
+	var args []interface{}
+
+	if userType := c.QueryParam("type"); userType != "" {
+		condition += " AND `type` = ?"
+		args = append(args, userType)
+	}
+	if status := c.QueryParam("status"); status != "" {
+		condition += " AND `status` = ?"
+		args = append(args, status)
+	}
+	if code := c.QueryParam("code"); code != "" {
+		condition += " AND `code` LIKE ?"
+		args = append(args, code+"%")
+	}
+
+	condition += " ORDER BY `code`"
+
+	var page int
+	if c.QueryParam("page") == "" {
+		page = 1
+	} else {
+		var err error
+		page, err = strconv.Atoi(c.QueryParam("page"))
+		if err != nil || page <= 0 {
+			return c.String(http.StatusBadRequest, "Invalid page.")
+		}
+	}
+	limit := 100
+	offset := limit * (page - 1)
+
+	// limitより多く上限を設定し、実際にlimitより多くレコードが取得できた場合は次のページが存在する
+	condition += " LIMIT ? OFFSET ?"
+	args = append(args, limit+1, offset)
+
+	// 結果が0件の時は空配列を返却
+	res := make([]UserResponse, 0)
+	if err := h.DB.Select(&res, query+condition, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var links []string
+	linkURL, err := url.Parse(c.Request().URL.Path + "?" + c.Request().URL.RawQuery)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	q := linkURL.Query()
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page-1))
+		linkURL.RawQuery = q.Encode()
+		links = append(links, fmt.Sprintf("<%v>; rel=\"prev\"", linkURL))
+	}
+	if len(res) > limit {
+		q.Set("page", strconv.Itoa(page+1))
+		linkURL.RawQuery = q.Encode()
+		links = append(links, fmt.Sprintf("<%v>; rel=\"next\"", linkURL))
+	}
+	if len(links) > 0 {
+		c.Response().Header().Set("Link", strings.Join(links, ","))
+	}
+
+	if len(res) == limit+1 {
+		res = res[:len(res)-1]
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+type CreateUserRequest struct {
+	Code     string   `json:"code"`
+	Name     string   `json:"name"`
+	Type     UserType `json:"type"`
+	Password string   `json:"password"`
+}
+
+type CreateUserResponse struct {
+	ID string `json:"id"`
+}
+
+// CreateUser POST /api/users ユーザーの新規作成
+func (h *handlers) CreateUser(c echo.Context) error {
+	var req CreateUserRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if msg := validateUserFields(req.Code, req.Name, req.Type); msg != "" {
+		return c.String(http.StatusBadRequest, msg)
+	}
+	if err := validatePassword(req.Password); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	userID := newULID()
+	if _, err := tx.Exec("INSERT INTO `users` (`id`, `code`, `name`, `hashed_password`, `type`) VALUES (?, ?, ?, ?, ?)",
+		userID, req.Code, req.Name, hashedPassword, req.Type); err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+			return c.String(http.StatusConflict, "A user with the same code already exists.")
+		}
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := writeAuditLog(c, tx, AuditEntry{Action: AuditCreateUser, After: UserResponse{Code: req.Code, Name: req.Name, Type: req.Type, Status: UserActive}}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, CreateUserResponse{ID: userID})
+}
+
+type UpdateUserRequest struct {
+	Name string   `json:"name"`
+	Type UserType `json:"type"`
+}
+
+// UpdateUser PUT /api/users/:userCode ユーザー情報の更新
+// ユーザー種別が変わった場合は既存のセッションを無効化する
+func (h *handlers) UpdateUser(c echo.Context) error {
+	userCode := c.Param("userCode")
+
+	var req UpdateUserRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if msg := validateUserFields(userCode, req.Name, req.Type); msg != "" {
+		return c.String(http.StatusBadRequest, msg)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var user User
+	if err := tx.Get(&user, "SELECT * FROM `users` WHERE `code` = ? FOR UPDATE", userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+
+	if _, err := tx.Exec("UPDATE `users` SET `name` = ?, `type` = ? WHERE `id` = ?", req.Name, req.Type, user.ID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action: AuditUpdateUser,
+		Before: UserResponse{Code: user.Code, Name: user.Name, Type: user.Type, Status: user.Status},
+		After:  UserResponse{Code: user.Code, Name: req.Name, Type: req.Type, Status: user.Status},
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	teacherNameCache.Delete(user.ID)
+
+	if user.Type != req.Type {
+		if err := h.Sessions.RevokeUserSessions(c.Request().Context(), user.ID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type SetUserStatusRequest struct {
+	Status UserStatus `json:"status"`
+}
+
+// SetUserStatus PUT /api/users/:userCode/status アカウントの状態の変更
+func (h *handlers) SetUserStatus(c echo.Context) error {
+	var req SetUserStatusRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if !isValidUserStatus(req.Status) {
+		return c.String(http.StatusBadRequest, "Invalid user status.")
+	}
+
+	return h.setUserStatus(c, c.Param("userCode"), req.Status)
+}
+
+// SuspendUser DELETE /api/users/:userCode ユーザーの利用停止
+func (h *handlers) SuspendUser(c echo.Context) error {
+	return h.setUserStatus(c, c.Param("userCode"), UserSuspended)
+}
+
+// setUserStatus アカウントの状態を変更する
+// active 以外にした場合は既存のセッションを無効にし、以降のアクセスを即座に拒否する
+func (h *handlers) setUserStatus(c echo.Context, userCode string, status UserStatus) error {
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var user User
+	if err := tx.Get(&user, "SELECT * FROM `users` WHERE `code` = ? FOR UPDATE", userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+
+	if user.Status == status {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	if _, err := tx.Exec("UPDATE `users` SET `status` = ? WHERE `id` = ?", status, user.ID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action: AuditSetUserStatus,
+		Before: UserResponse{Code: user.Code, Name: user.Name, Type: user.Type, Status: user.Status},
+		After:  UserResponse{Code: user.Code, Name: user.Name, Type: user.Type, Status: status},
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if status == UserActive {
+		return c.NoContent(http.StatusNoContent)
+	}
+	if err := h.Sessions.RevokeUserSessions(c.Request().Context(), user.ID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// CSVの列
+var importUsersHeader = []string{"code", "name", "type", "password"}
+
+type ImportUsersError struct {
+	Row     int    `json:"row"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportUsersErrorResponse struct {
+	Errors []ImportUsersError `json:"errors"`
+}
+
+type ImportUsersResponse struct {
+	Created int `json:"created"`
+}
+
+// ImportUsers POST /api/users/import CSVによるユーザーの一括登録
+// 1行でもエラーがあれば1件も登録せず、行毎のエラーを返す
+func (h *handlers) ImportUsers(c echo.Context) error {
+	var body io.Reader = c.Request().Body
+	if file, _, err := c.Request().FormFile("file"); err == nil {
+		defer file.Close()
+		body = file
+	}
+
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = len(importUsersHeader)
+	header, err := r.Read()
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid CSV.")
+	}
+	for i, column := range importUsersHeader {
+		if strings.TrimPrefix(strings.TrimSpace(header[i]), "\ufeff") != column {
+			return c.String(http.StatusBadRequest, "Invalid CSV header: expected "+strings.Join(importUsersHeader, ","))
+		}
+	}
+
+	var requests []CreateUserRequest
+	var errors []ImportUsersError
+	rows := map[string]int{}
+	for row := 2; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			errors = append(errors, ImportUsersError{Row: row, Message: err.Error()})
+			break
+		}
+		req := CreateUserRequest{
+			Code:     strings.TrimSpace(record[0]),
+			Name:     strings.TrimSpace(record[1]),
+			Type:     UserType(strings.TrimSpace(record[2])),
+			Password: record[3],
+		}
+		if msg := validateUserFields(req.Code, req.Name, req.Type); msg != "" {
+			errors = append(errors, ImportUsersError{Row: row, Code: req.Code, Message: msg})
+		} else if err := validatePassword(req.Password); err != nil {
+			errors = append(errors, ImportUsersError{Row: row, Code: req.Code, Message: err.Error()})
+		} else if dup, ok := rows[req.Code]; ok {
+			errors = append(errors, ImportUsersError{Row: row, Code: req.Code, Message: fmt.Sprintf("Duplicate code in row %d.", dup)})
+		} else {
+			rows[req.Code] = row
+			requests = append(requests, req)
+		}
+	}
+	if len(requests) == 0 && len(errors) == 0 {
+		return c.String(http.StatusBadRequest, "No users to import.")
+	}
+
+	if len(requests) > 0 {
+		codes := make([]string, 0, len(requests))
+		for _, req := range requests {
+			codes = append(codes, req.Code)
+		}
+		q, args, err := sqlx.In("SELECT `code` FROM `users` WHERE `code` IN (?)", codes)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		var existing []string
+		if err := h.DB.Select(&existing, q, args...); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for _, code := range existing {
+			errors = append(errors, ImportUsersError{Row: rows[code], Code: code, Message: "A user with the same code already exists."})
+		}
+	}
+	if len(errors) > 0 {
+		sortImportUsersErrors(errors)
+		return c.JSON(http.StatusBadRequest, ImportUsersErrorResponse{Errors: errors})
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	created := make([]UserResponse, 0, len(requests))
+	for _, req := range requests {
+		hashedPassword, err := hashPassword(req.Password)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if _, err := tx.Exec("INSERT INTO `users` (`id`, `code`, `name`, `hashed_password`, `type`) VALUES (?, ?, ?, ?, ?)",
+			newULID(), req.Code, req.Name, hashedPassword, req.Type); err != nil {
+			if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+				return c.JSON(http.StatusBadRequest, ImportUsersErrorResponse{Errors: []ImportUsersError{
+					{Row: rows[req.Code], Code: req.Code, Message: "A user with the same code already exists."},
+				}})
+			}
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		created = append(created, UserResponse{Code: req.Code, Name: req.Name, Type: req.Type, Status: UserActive})
+	}
+
+	if err := writeAuditLog(c, tx, AuditEntry{Action: AuditImportUsers, After: created}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, ImportUsersResponse{Created: len(created)})
+}
+
+func sortImportUsersErrors(errors []ImportUsersError) {
+	sort.SliceStable(errors, func(i, j int) bool {
+		return errors[i].Row < errors[j].Row
+	})
+}
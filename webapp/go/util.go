@@ -4,6 +4,7 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,6 +19,14 @@ func GetEnv(key, val string) string {
 	}
 }
 
+func GetEnvInt(key string, val int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err != nil {
+		return val
+	} else {
+		return v
+	}
+}
+
 func contains(arr []DayOfWeek, day DayOfWeek) bool {
 	for _, v := range arr {
 		if v == day {
@@ -27,6 +36,38 @@ func contains(arr []DayOfWeek, day DayOfWeek) bool {
 	return false
 }
 
+func containsTokenScope(arr []TokenScope, scope TokenScope) bool {
+	for _, v := range arr {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(arr []string, s string) bool {
+	for _, v := range arr {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func equalTimePtr(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func equalIntPtr(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
 var (
 	entropy     = ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0)
 	entropyLock sync.Mutex
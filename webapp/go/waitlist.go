@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ---------- Capacity & Waitlist ----------
+
+// 定員 (courses.capacity) が NULL の科目は定員なし。
+// 定員に達した科目は RegisterCourses で waitlist を指定した場合にキャンセル待ちに登録され、
+// 空きが出ると登録順に繰り上げて履修登録し、本人宛てのお知らせで通知する。
+
+// lockCourseCapacity 科目の行をロックし、最新の定員と履修者数を返す
+// 同じ科目への履修登録はこのロックで直列化される
+func lockCourseCapacity(tx *sqlx.Tx, courseID string) (capacity *int, registered int, err error) {
+	return readCourseCapacity(tx, courseID, " FOR UPDATE")
+}
+
+// peekCourseCapacity ロックせずに定員と履修者数を返す (dry-runの確認用)
+func peekCourseCapacity(tx *sqlx.Tx, courseID string) (capacity *int, registered int, err error) {
+	return readCourseCapacity(tx, courseID, "")
+}
+
+func readCourseCapacity(tx *sqlx.Tx, courseID, lock string) (capacity *int, registered int, err error) {
+	if err := tx.Get(&capacity, "SELECT `capacity` FROM `courses` WHERE `id` = ?"+lock, courseID); err != nil {
+		return nil, 0, err
+	}
+	if err := tx.Get(&registered, "SELECT COUNT(*) FROM `registrations` WHERE `course_id` = ?", courseID); err != nil {
+		return nil, 0, err
+	}
+	return capacity, registered, nil
+}
+
+// WaitlistPromotion キャンセル待ちから繰り上げた学生と通知したお知らせ
+type WaitlistPromotion struct {
+	UserID         string
+	AnnouncementID string
+}
+
+// promoteWaitlist 定員に空きがあればキャンセル待ちの学生を登録順に繰り上げて履修登録する
+// 時間割が重複する学生、単位数の上限を超える学生と利用停止中の学生は飛ばし、キャンセル待ちのまま残す。
+// 呼び出し側のトランザクション内で実行し、繰り上げた学生を返す。
+// Redisへの反映はコミット後に呼び出し側が publishPromotions で行う
+func (h *handlers) promoteWaitlist(tx *sqlx.Tx, courseID string) ([]WaitlistPromotion, error) {
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); err != nil {
+		return nil, err
+	}
+	if course.Status == StatusClosed {
+		return nil, nil
+	}
+	var registered int
+	if err := tx.Get(&registered, "SELECT COUNT(*) FROM `registrations` WHERE `course_id` = ?", courseID); err != nil {
+		return nil, err
+	}
+	if course.Capacity != nil && registered >= *course.Capacity {
+		return nil, nil
+	}
+
+	var waiting []string
+	query := "SELECT `waitlists`.`user_id`" +
+		" FROM `waitlists`" +
+		" JOIN `users` ON `waitlists`.`user_id` = `users`.`id`" +
+		" WHERE `waitlists`.`course_id` = ? AND `users`.`status` = ?" +
+		" ORDER BY `waitlists`.`created_at`, `waitlists`.`user_id`"
+	if err := tx.Select(&waiting, query, courseID, UserActive); err != nil {
+		return nil, err
+	}
+
+	var promoted []WaitlistPromotion
+	for _, userID := range waiting {
+		if course.Capacity != nil && registered >= *course.Capacity {
+			break
+		}
+
+		var conflicts int
+		query := "SELECT COUNT(*)" +
+			" FROM `registrations`" +
+			" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id`" +
+			" JOIN `course_slots` ON `course_slots`.`course_id` = `courses`.`id`" +
+			" JOIN `course_slots` AS `target` ON `target`.`course_id` = ?" +
+			"   AND `target`.`day_of_week` = `course_slots`.`day_of_week` AND `target`.`period` = `course_slots`.`period`" +
+			" WHERE `registrations`.`user_id` = ? AND `courses`.`status` != ? AND `courses`.`term_id` <=> ?"
+		if err := tx.Get(&conflicts, query, courseID, userID, StatusClosed, course.TermID); err != nil {
+			return nil, err
+		}
+		if conflicts > 0 {
+			continue
+		}
+
+		limit, err := getCreditLimit(tx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 {
+			var credits int
+			query := "SELECT IFNULL(SUM(`courses`.`credit`), 0)" +
+				" FROM `registrations`" +
+				" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id`" +
+				" WHERE `registrations`.`user_id` = ? AND `courses`.`status` != ? AND `courses`.`term_id` <=> ?"
+			if err := tx.Get(&credits, query, userID, StatusClosed, course.TermID); err != nil {
+				return nil, err
+			}
+			if credits+int(course.Credit) > limit {
+				continue
+			}
+		}
+
+		if _, err := tx.Exec("INSERT IGNORE INTO `registrations` (`course_id`, `user_id`) VALUES (?, ?)", courseID, userID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM `waitlists` WHERE `course_id` = ? AND `user_id` = ?", courseID, userID); err != nil {
+			return nil, err
+		}
+
+		announcementID := newULID()
+		if _, err := tx.Exec("INSERT INTO `announcements` (`id`, `course_id`, `course_name`, `title`, `message`, `recipient_id`) VALUES (?, ?, ?, ?, ?, ?)",
+			announcementID, courseID, course.Name,
+			"キャンセル待ち繰り上げ: "+course.Name,
+			fmt.Sprintf("%s に空きが出たため、キャンセル待ちから履修登録されました。", course.Name),
+			userID); err != nil {
+			return nil, err
+		}
+
+		registered++
+		promoted = append(promoted, WaitlistPromotion{UserID: userID, AnnouncementID: announcementID})
+	}
+
+	return promoted, nil
+}
+
+// publishPromotions 繰り上げた学生の履修登録と未読のお知らせをRedisに反映する (コミット後に呼ぶ)
+func (h *handlers) publishPromotions(ctx context.Context, courseID string, promoted []WaitlistPromotion) error {
+	for _, p := range promoted {
+		if err := h.Redis.SAdd(ctx, "registrations:"+courseID, p.UserID).Err(); err != nil {
+			return err
+		}
+		if err := h.Redis.SAdd(ctx, "unread_announcements:"+p.UserID, p.AnnouncementID).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type SetCourseCapacityRequest struct {
+	Capacity *int `json:"capacity"`
+}
+
+// SetCourseCapacity PUT /api/courses/:courseID/capacity 科目の定員の変更
+// 定員を増やした場合はキャンセル待ちの学生を繰り上げる
+func (h *handlers) SetCourseCapacity(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var req SetCourseCapacityRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if req.Capacity != nil && *req.Capacity <= 0 {
+		return c.String(http.StatusBadRequest, "Invalid capacity.")
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var course Course
+	if err := tx.Get(&course, "SELECT * FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such course.")
+	}
+
+	if _, err := tx.Exec("UPDATE `courses` SET `capacity` = ? WHERE `id` = ?", req.Capacity, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := writeAuditLog(c, tx, AuditEntry{
+		Action:   AuditSetCourseCapacity,
+		CourseID: courseID,
+		Before:   SetCourseCapacityRequest{Capacity: course.Capacity},
+		After:    req,
+	}); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	promoted, err := h.promoteWaitlist(tx, courseID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	course.Capacity = req.Capacity
+	courseCache.Store(courseID, course)
+	if err := h.publishPromotions(c.Request().Context(), courseID, promoted); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+type WaitlistEntry struct {
+	CourseID   string `json:"course_id" db:"course_id"`
+	CourseName string `json:"course_name" db:"course_name"`
+	Position   int    `json:"position" db:"position"`
+}
+
+// GetMyWaitlist GET /api/users/me/waitlist キャンセル待ち中の科目一覧取得
+func (h *handlers) GetMyWaitlist(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	query := "SELECT `w`.`course_id`, `courses`.`name` AS `course_name`," +
+		"   (SELECT COUNT(*) FROM `waitlists` AS `w2`" +
+		"     WHERE `w2`.`course_id` = `w`.`course_id`" +
+		"       AND (`w2`.`created_at`, `w2`.`user_id`) <= (`w`.`created_at`, `w`.`user_id`)) AS `position`" +
+		" FROM `waitlists` AS `w`" +
+		" JOIN `courses` ON `w`.`course_id` = `courses`.`id`" +
+		" WHERE `w`.`user_id` = ? AND `courses`.`status` != ?" +
+		" ORDER BY `w`.`created_at`"
+	res := make([]WaitlistEntry, 0)
+	if err := h.DB.Select(&res, query, userID, StatusClosed); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// LeaveWaitlist DELETE /api/users/me/waitlist/:courseID キャンセル待ちの取り消し
+func (h *handlers) LeaveWaitlist(c echo.Context) error {
+	userID, _, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	result, err := h.DB.Exec("DELETE FROM `waitlists` WHERE `course_id` = ? AND `user_id` = ?", c.Param("courseID"), userID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.String(http.StatusNotFound, "You are not on the waitlist of this course.")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
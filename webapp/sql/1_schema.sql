@@ -1,11 +1,33 @@
 -- CREATEと逆順
+DROP TABLE IF EXISTS `audit_logs`;
+DROP TABLE IF EXISTS `api_tokens`;
 DROP TABLE IF EXISTS `unread_announcements`;
 DROP TABLE IF EXISTS `announcements`;
 DROP TABLE IF EXISTS `submissions`;
 DROP TABLE IF EXISTS `classes`;
+DROP TABLE IF EXISTS `waitlists`;
 DROP TABLE IF EXISTS `registrations`;
+DROP TABLE IF EXISTS `course_prerequisites`;
+DROP TABLE IF EXISTS `course_staff`;
+DROP TABLE IF EXISTS `course_slots`;
 DROP TABLE IF EXISTS `courses`;
+DROP TABLE IF EXISTS `credit_limit_overrides`;
 DROP TABLE IF EXISTS `users`;
+DROP TABLE IF EXISTS `terms`;
+
+-- 学期 (履修登録期間は科目毎の期間が未設定の科目に適用する)
+CREATE TABLE `terms`
+(
+    `id`                     CHAR(26) CHARACTER SET latin1,
+    `code`                   VARCHAR(32) CHARACTER SET latin1 NOT NULL,
+    `name`                   VARCHAR(255)                     NOT NULL,
+    `starts_on`              DATE                             NOT NULL,
+    `ends_on`                DATE                             NOT NULL,
+    `registration_opens_at`  DATETIME(6),
+    `registration_closes_at` DATETIME(6),
+    PRIMARY KEY (`id`),
+    UNIQUE (`code`)
+);
 
 -- master data
 CREATE TABLE `users`
@@ -14,11 +36,20 @@ CREATE TABLE `users`
     `code`            CHAR(6) CHARACTER SET latin1  NOT NULL,
     `name`            VARCHAR(255)                NOT NULL,
     `hashed_password` BINARY(60)                  NOT NULL,
-    `type`            ENUM ('student', 'teacher') NOT NULL,
+    `type`            ENUM ('student', 'teacher', 'admin') NOT NULL,
+    `status`          ENUM ('active', 'suspended', 'graduated') NOT NULL DEFAULT 'active',
     PRIMARY KEY(`id`),
     UNIQUE (`code`)
 );
 
+-- 学生毎の1学期の単位数の上限 (管理者が設定、未設定なら既定値)
+CREATE TABLE `credit_limit_overrides`
+(
+    `user_id`      CHAR(26) CHARACTER SET latin1,
+    `credit_limit` INT UNSIGNED NOT NULL,
+    PRIMARY KEY (`user_id`)
+);
+
 CREATE TABLE `courses`
 (
     `id`          CHAR(26) CHARACTER SET latin1,
@@ -32,12 +63,48 @@ CREATE TABLE `courses`
     `teacher_id`  CHAR(26) CHARACTER SET latin1                                 NOT NULL,
     `keywords`    TEXT                                                          NOT NULL,
     `status`      ENUM ('registration', 'in-progress', 'closed')                NOT NULL DEFAULT 'registration',
+    `term_id`     CHAR(26) CHARACTER SET latin1,
+    `capacity`    INT UNSIGNED,
+    `started_at`  DATETIME(6),
+    `registration_opens_at`  DATETIME(6),
+    `registration_closes_at` DATETIME(6),
 --    CONSTRAINT FK_courses_teacher_id FOREIGN KEY (`teacher_id`) REFERENCES `users` (`id`),
     INDEX (`teacher_id`),
+    INDEX (`term_id`),
     PRIMARY KEY(`id`),
     UNIQUE (`code`)
 );
 
+-- 科目の時間割枠 (`courses`.`period` / `day_of_week` は最初の枠)
+CREATE TABLE `course_slots`
+(
+    `course_id`   CHAR(26) CHARACTER SET latin1,
+    `day_of_week` ENUM ('monday', 'tuesday', 'wednesday', 'thursday', 'friday') NOT NULL,
+    `period`      TINYINT UNSIGNED                                              NOT NULL,
+    INDEX (`day_of_week`, `period`),
+    PRIMARY KEY (`course_id`, `day_of_week`, `period`)
+);
+
+-- 科目の共同担当教員とTA (`courses`.`teacher_id` 以外の担当者)
+CREATE TABLE `course_staff`
+(
+    `course_id` CHAR(26) CHARACTER SET latin1,
+    `user_id`   CHAR(26) CHARACTER SET latin1,
+    `role`      ENUM ('teacher', 'assistant') NOT NULL,
+    PRIMARY KEY (`course_id`, `user_id`),
+    INDEX (`user_id`)
+);
+
+-- 科目の履修条件 (前提科目を修了し、その合計点が `min_total_score` 以上)
+CREATE TABLE `course_prerequisites`
+(
+    `course_id`       CHAR(26) CHARACTER SET latin1,
+    `prerequisite_id` CHAR(26) CHARACTER SET latin1,
+    `min_total_score` INT UNSIGNED NOT NULL DEFAULT 60,
+    PRIMARY KEY (`course_id`, `prerequisite_id`),
+    INDEX (`prerequisite_id`)
+);
+
 CREATE TABLE `registrations`
 (
     `course_id` CHAR(26) CHARACTER SET latin1,
@@ -48,6 +115,17 @@ CREATE TABLE `registrations`
     INDEX (`user_id`)
 );
 
+-- 定員に達した科目のキャンセル待ち (`created_at` 順に繰り上げる)
+CREATE TABLE `waitlists`
+(
+    `course_id`  CHAR(26) CHARACTER SET latin1,
+    `user_id`    CHAR(26) CHARACTER SET latin1,
+    `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    PRIMARY KEY (`course_id`, `user_id`),
+    INDEX (`course_id`, `created_at`),
+    INDEX (`user_id`)
+);
+
 CREATE TABLE `classes`
 (
     `id`                CHAR(26) CHARACTER SET latin1,
@@ -81,6 +159,7 @@ CREATE TABLE `announcements`
     `course_name` VARCHAR(255) NOT NULL,
     `title`      VARCHAR(255) NOT NULL,
     `message`    TEXT         NOT NULL,
+    `recipient_id` CHAR(26) CHARACTER SET latin1,
 --    CONSTRAINT FK_announcements_course_id FOREIGN KEY (`course_id`) REFERENCES `courses` (`id`),
     INDEX (`course_id`),
     PRIMARY KEY(`id`)
@@ -96,3 +175,37 @@ CREATE TABLE `unread_announcements`
 --    CONSTRAINT FK_unread_announcements_user_id FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
 --    INDEX (`user_id`)
 );
+
+CREATE TABLE `api_tokens`
+(
+    `id`           CHAR(26) CHARACTER SET latin1,
+    `user_id`      CHAR(26) CHARACTER SET latin1 NOT NULL,
+    `name`         VARCHAR(255)                  NOT NULL,
+    `token_hash`   BINARY(32)                    NOT NULL,
+    `scopes`       SET ('read-only', 'scores', 'calendar') NOT NULL DEFAULT '',
+    `created_at`   DATETIME(6)                   NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    `last_used_at` DATETIME(6),
+    `expires_at`   DATETIME(6),
+    INDEX (`user_id`),
+    UNIQUE (`token_hash`),
+    PRIMARY KEY(`id`)
+);
+
+-- 管理操作の監査ログ (追記のみ)
+CREATE TABLE `audit_logs`
+(
+    `id`              CHAR(26) CHARACTER SET latin1,
+    `actor_id`        CHAR(26) CHARACTER SET latin1 NOT NULL,
+    `action`          VARCHAR(64) CHARACTER SET latin1 NOT NULL,
+    `course_id`       CHAR(26) CHARACTER SET latin1,
+    `class_id`        CHAR(26) CHARACTER SET latin1,
+    `announcement_id` CHAR(26) CHARACTER SET latin1,
+    `before`          JSON,
+    `after`           JSON,
+    `request_id`      VARCHAR(255) CHARACTER SET latin1 NOT NULL,
+    `created_at`      DATETIME(6)                   NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX (`actor_id`),
+    INDEX (`course_id`),
+    INDEX (`action`),
+    PRIMARY KEY(`id`)
+);
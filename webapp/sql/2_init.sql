@@ -5081,3 +5081,7 @@ INSERT INTO `courses` (`id`, `code`, `type`, `name`, `description`, `credit`, `p
 ('01FF6N3NA2J712CAH9YWXTWF89', 'A0028', 'major-subjects', '量子言語メカトロニクス特論', '本講義では出席を毎回取る。成績は出席と課題の提出状況により判断する。', 1, 4, 'friday', '01FF6J8XFSX748CNN1MTCEY4VT', '言語 メカトロニクス', 'closed'),
 ('01FF6N3NA2J712CAH9YYQAE96H', 'A0029', 'liberal-arts', '社会サイエンス第二', '本講義では出席を毎回取る。成績は課題の提出状況により判断する。', 2, 5, 'friday', '01FF6J8XFS4N2RA3TS2B2SK600', '社会 サイエンス', 'closed'),
 ('01FF6N3NA2J712CAH9Z1KYVWKM', 'A0030', 'major-subjects', '機能的プログラミング力学基礎', '本講義では課題提出をもって出席の代わりとする。成績は課題の提出状況により判断する。', 3, 6, 'friday', '01FF6J8XFTM3BB01XKXYNGBKKM', 'プログラミング 力学', 'closed');
+
+-- 週1回の科目の時間割枠
+INSERT INTO `course_slots` (`course_id`, `day_of_week`, `period`)
+SELECT `id`, `day_of_week`, `period` FROM `courses` WHERE `id` NOT IN (SELECT `course_id` FROM `course_slots`);